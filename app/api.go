@@ -0,0 +1,193 @@
+package app
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The JSON API mirrors the pages for scripts and other clients.
+// Requests authenticate with the token returned when creating or joining a connection
+// as an Authorization: Bearer header, it is equivalent to the Session cookie.
+// Errors are returned as {"error": ClientError} with the status of the error.
+//
+//	POST   /api/v1/connections                     create a connection, {"mode", "passphrase", "expiry", "receivers"}
+//	                                               with expiry like "10m" and the receivers a broadcast waits for
+//	POST   /api/v1/connections/{id}/join           join a connection as receiver, {"passphrase"}
+//	GET    /api/v1/connections/{id}                get the status of a connection
+//	DELETE /api/v1/connections/{id}/receivers      revoke the receiver that joined a connection
+//	POST   /api/v1/connections/{id}/files          upload files as multipart/form-data, see transferUpload
+//	POST   /api/v1/connections/{id}/uploads        chunked uploads, see uploads.go
+//	GET    /api/v1/connections/{id}/download       download the next file or all files with ?archive=zip|tar
+//	GET    /api/v1/connections/{id}/files/{index}  download a file
+//	GET    /api/v1/connections/{id}/events         stream events with unrendered data
+func (app *App) mountAPI(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/connections", app.withAPIError(app.apiCreate))
+	mux.HandleFunc("POST /api/v1/connections/{id}/join", app.withAPIError(app.apiJoin))
+	mux.HandleFunc("GET /api/v1/connections/{id}", app.withAPIError(app.apiStatus))
+	mux.HandleFunc("DELETE /api/v1/connections/{id}/receivers", app.withAPIError(app.transferKick))
+	mux.Handle("POST /api/v1/connections/{id}/files", withTimeout(app.withAPIError(app.transferUpload), app.config.TransferTimeout))
+	mux.HandleFunc("POST /api/v1/connections/{id}/uploads", app.withAPIError(app.uploadCreate))
+	mux.HandleFunc("HEAD /api/v1/connections/{id}/uploads/{index}", app.withAPIError(app.uploadOffset))
+	mux.Handle("PATCH /api/v1/connections/{id}/uploads/{index}", withTimeout(app.withAPIError(app.uploadChunk), app.config.TransferTimeout))
+	mux.Handle("GET /api/v1/connections/{id}/download", withTimeout(app.withAPIError(app.transferDownload), app.config.TransferTimeout))
+	mux.Handle("GET /api/v1/connections/{id}/files/{index}", withTimeout(app.withAPIError(app.transferDownload), app.config.TransferTimeout))
+	mux.HandleFunc("GET /api/v1/connections/{id}/events", app.withAPIError(app.apiEvents))
+}
+
+type apiSession struct {
+	ID        string    `json:"id"`
+	Peer      Peer      `json:"peer"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type apiStatus struct {
+	ID        string    `json:"id"`
+	Mode      ConnMode  `json:"mode"`
+	Protected bool      `json:"protected"`
+	State     ConnState `json:"state"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Joined    bool      `json:"joined"`
+	Manifest  *Headers  `json:"manifest,omitempty"`
+	Progress  int64     `json:"progress"`
+	Uploaded  bool      `json:"uploaded"`
+	Done      bool      `json:"done"`
+	Error     string    `json:"error,omitempty"`
+	// Checksums are the hex encoded SHA-256 checksums of the files sent so far.
+	Checksums []string `json:"checksums,omitempty"`
+}
+
+func (app *App) apiCreate(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Mode       string `json:"mode"`
+		Passphrase string `json:"passphrase"`
+		Expiry     string `json:"expiry"`
+		Receivers  int    `json:"receivers"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		return err
+	}
+	id, err := app.createConnection(body.Mode, body.Passphrase, body.Expiry, body.Receivers)
+	if err != nil {
+		return err
+	}
+	return app.apiIssueSession(w, id, PeerSender, http.StatusCreated)
+}
+
+func (app *App) apiJoin(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		return err
+	}
+	id := r.PathValue("id")
+	if err := app.joinConnection(id, body.Passphrase); err != nil {
+		return err
+	}
+	return app.apiIssueSession(w, id, PeerReceiver, http.StatusOK)
+}
+
+func (app *App) apiStatus(w http.ResponseWriter, r *http.Request) error {
+	id := r.PathValue("id")
+	pid, err := sessionPid(r)
+	if err == nil {
+		_, err = app.portal.Authenticate(id, pid)
+	}
+	if err != nil {
+		return NewClientError(err, "Unauthorized").
+			WithDesc("Create or join the connection first.").
+			WithStatus(http.StatusUnauthorized)
+	}
+	conn, err := app.portal.GetConnection(id)
+	if err != nil {
+		return NewClientError(err, "Connection not found").
+			WithDesc("The connection has expired.").
+			WithStatus(http.StatusNotFound)
+	}
+	status := apiStatus{
+		ID:        id,
+		Mode:      conn.Mode(),
+		Protected: conn.Protected(),
+		State:     conn.State(),
+		ExpiresAt: conn.ExpiresAt(),
+		Joined:    isClosed(conn.AnyJoined()),
+		Progress:  conn.Progress(),
+		Uploaded:  conn.Sent(),
+		Done:      isClosed(conn.Done()),
+	}
+	if headers, ok := conn.Headers(); ok {
+		status.Manifest = &headers
+		for i := range headers.Files {
+			sum, ok := conn.Checksum(i)
+			if !ok {
+				break
+			}
+			status.Checksums = append(status.Checksums, hex.EncodeToString(sum))
+		}
+	}
+	if err := conn.Err(); err != nil {
+		status.Error = err.Error()
+	}
+	return writeJSON(w, http.StatusOK, status)
+}
+
+func (app *App) apiEvents(w http.ResponseWriter, r *http.Request) error {
+	return app.streamEvents(w, r, func(_ string, _ Peer, mssg Mssg) string {
+		// multiline data is not valid in a single data field
+		return strings.ReplaceAll(mssg.Data, "\n", " ")
+	})
+}
+
+// apiIssueSession responds with a new token for peer in connection id.
+func (app *App) apiIssueSession(w http.ResponseWriter, id string, peer Peer, status int) error {
+	token, err := app.issueToken(id, peer)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, status, apiSession{ID: id, Peer: peer, Token: token.Pid(), ExpiresAt: token.ExpiresAt})
+}
+
+func (app *App) withAPIError(handler func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := handler(w, r)
+		if err == nil {
+			return
+		}
+		log.Println("err:", err)
+		cerr, ok := err.(ClientError)
+		if !ok {
+			cerr = NewClientError(err, "Something went wrong!").WithStatus(http.StatusInternalServerError)
+		}
+		if err := writeJSON(w, cerr.Status, map[string]ClientError{"error": cerr}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil && err != io.EOF {
+		return NewClientError(err, "Invalid request").WithDesc("The request body must be valid JSON.")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
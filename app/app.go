@@ -2,26 +2,56 @@ package app
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/eriicafes/httportal/qr"
 	"github.com/eriicafes/httportal/views/pages"
 	"github.com/eriicafes/httportal/views/partials"
 	"github.com/eriicafes/tmpl"
 )
 
+// Config is the server configuration of an App.
+type Config struct {
+	Throttle ThrottleOptions
+	Policy   Policy
+	// TrustProxy identifies clients by the X-Forwarded-For header set by a reverse proxy.
+	TrustProxy bool
+	// TransferTimeout bounds each upload and download request, 5 minutes by default.
+	TransferTimeout time.Duration
+	// SessionTTL is how long the sessions of peers are valid, an hour by default.
+	SessionTTL time.Duration
+}
+
 type App struct {
 	tmpl.Templates
-	portal *Portal
+	portal   *Portal
+	config   Config
+	throttle *Throttle
 }
 
-func New(tp tmpl.Templates, p *Portal) *App {
-	return &App{Templates: tp, portal: p}
+func New(tp tmpl.Templates, p *Portal, config Config) *App {
+	if config.TransferTimeout <= 0 {
+		config.TransferTimeout = time.Minute * 5
+	}
+	if config.SessionTTL <= 0 {
+		config.SessionTTL = time.Hour
+	}
+	return &App{Templates: tp, portal: p, config: config, throttle: NewThrottle(config.Throttle)}
 }
 
 func (app *App) Mount(mux *http.ServeMux) {
@@ -30,9 +60,16 @@ func (app *App) Mount(mux *http.ServeMux) {
 	mux.HandleFunc("POST /send", app.withError(app.sendPost))
 	mux.HandleFunc("GET /receive", app.withError(app.receive))
 	mux.HandleFunc("POST /receive", app.withError(app.receivePost))
-	mux.Handle("POST /transfer/{id}", http.TimeoutHandler(app.withError(app.transferUpload), time.Minute*5, "Upload timed out"))
-	mux.Handle("GET /transfer/{id}", http.TimeoutHandler(app.withError(app.transferDownload), time.Minute*5, "Download timed out"))
+	mux.Handle("POST /transfer/{id}", withTimeout(app.withError(app.transferUpload), app.config.TransferTimeout))
+	mux.Handle("GET /transfer/{id}", withTimeout(app.withError(app.transferDownload), app.config.TransferTimeout))
+	mux.Handle("GET /transfer/{id}/files/{index}", withTimeout(app.withError(app.transferDownload), app.config.TransferTimeout))
 	mux.HandleFunc("GET /transfer/{id}/events", app.withError(app.transferEvents))
+	mux.HandleFunc("DELETE /transfer/{id}/receivers", app.withError(app.transferKick))
+	mux.HandleFunc("GET /transfer/{id}/qr.svg", app.withError(app.transferQR))
+	mux.HandleFunc("POST /transfer/{id}/uploads", app.withError(app.uploadCreate))
+	mux.HandleFunc("HEAD /transfer/{id}/uploads/{index}", app.withError(app.uploadOffset))
+	mux.Handle("PATCH /transfer/{id}/uploads/{index}", withTimeout(app.withError(app.uploadChunk), app.config.TransferTimeout))
+	app.mountAPI(mux)
 }
 
 func (app *App) home(w http.ResponseWriter, r *http.Request) error {
@@ -40,66 +77,122 @@ func (app *App) home(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (app *App) send(w http.ResponseWriter, r *http.Request) error {
-	return app.Render(w, pages.SendPage{})
+	// senders can choose a shorter expiry than the longest one
+	expiries := []pages.Expiry{{Label: humanDuration(app.portal.MaxExpiry())}}
+	for _, expiry := range []time.Duration{time.Hour * 6, time.Hour, time.Minute * 30, time.Minute * 10} {
+		if expiry < app.portal.MaxExpiry() {
+			expiries = append(expiries, pages.Expiry{Value: expiry.String(), Label: humanDuration(expiry)})
+		}
+	}
+	return app.Render(w, pages.SendPage{Expiries: expiries})
 }
 
 func (app *App) sendPost(w http.ResponseWriter, r *http.Request) error {
-	// create connection
-	id, err := app.portal.CreateConnection()
+	receivers, _ := strconv.Atoi(r.FormValue("receivers"))
+	id, err := app.createConnection(r.FormValue("mode"), r.FormValue("passphrase"), r.FormValue("expiry"), receivers)
 	if err != nil {
-		return NewClientError(err, "Failed to create connection").
-			WithStatus(http.StatusInternalServerError)
+		return err
 	}
 	// set peer cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "Session",
-		Value:    PeerSender.Pid(id),
-		Path:     fmt.Sprintf("/transfer/%s", id),
-		Expires:  time.Now().Add(time.Hour),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
-	if err = app.RenderAssociated(w, pages.SendForm{ID: id}); err != nil {
+	if err = app.setSession(w, id, PeerSender); err != nil {
+		return err
+	}
+	broadcast := ConnMode(r.FormValue("mode")) == ModeBroadcast
+	if err = app.RenderAssociated(w, pages.SendForm{ID: id, Broadcast: broadcast}); err != nil {
 		return err
 	}
 	// send activity connector oob partial
 	return app.RenderAssociated(w, partials.ActivityConnector{ID: id})
 }
 
+// createConnection creates a connection with the mode, optional passphrase, optional expiry
+// and the number of receivers a broadcast waits for chosen by the sender.
+func (app *App) createConnection(mode string, passphrase string, expiry string, receivers int) (string, error) {
+	connMode, err := ParseConnMode(mode)
+	if err != nil {
+		return "", NewClientError(err, "Failed to create connection").
+			WithDesc("Invalid transfer mode.")
+	}
+	if receivers > 1 && connMode != ModeBroadcast {
+		return "", NewClientError(nil, "Failed to create connection").
+			WithDesc("Only broadcasts can wait for more than one receiver.")
+	}
+	if receivers < 0 || receivers > maxBroadcastReceivers {
+		return "", NewClientError(nil, "Failed to create connection").
+			WithDesc(fmt.Sprintf("A broadcast can wait for at most %d receivers.", maxBroadcastReceivers))
+	}
+	opts := ConnOptions{Mode: connMode, MinReceivers: receivers}
+	if expiry != "" {
+		opts.Expiry, err = time.ParseDuration(expiry)
+		if err != nil || opts.Expiry < time.Minute || opts.Expiry > app.portal.MaxExpiry() {
+			return "", NewClientError(err, "Failed to create connection").
+				WithDesc(fmt.Sprintf("Expiry must be between 1 minute and %s.", humanDuration(app.portal.MaxExpiry())))
+		}
+	}
+	if passphrase != "" {
+		if opts.Passphrase, err = NewPassphrase(passphrase); err != nil {
+			return "", NewClientError(err, "Failed to create connection").
+				WithDesc(fmt.Sprintf("Passphrase must be %d to %d characters long.", minPassphraseLen, maxPassphraseLen))
+		}
+	}
+	// create connection
+	id, err := app.portal.CreateConnection(opts)
+	if err != nil {
+		return "", NewClientError(err, "Failed to create connection").
+			WithStatus(http.StatusInternalServerError)
+	}
+	return id, nil
+}
+
 func (app *App) receive(w http.ResponseWriter, r *http.Request) error {
 	id := r.URL.Query().Get("id")
 	if id == "" {
-		return app.Render(w, pages.ReceivePage{})
+		return app.Render(w, pages.ReceivePage{CodeLen: app.portal.IDs().MaxLen()})
 	}
 	// get connection
 	conn, err := app.portal.GetConnection(id)
+	// protected connections ask for the passphrase before joining
+	if err == nil && conn.Protected() {
+		return app.Render(w, pages.ReceivePage{Code: id, CodeLen: app.portal.IDs().MaxLen()})
+	}
 	// check if connection is open
 	if err == nil && conn.CanEnter(PeerReceiver) {
 		// set peer cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "Session",
-			Value:    PeerReceiver.Pid(id),
-			Path:     fmt.Sprintf("/transfer/%s", id),
-			Expires:  time.Now().Add(time.Hour),
-			HttpOnly: true,
-			SameSite: http.SameSiteStrictMode,
-		})
+		if err = app.setSession(w, id, PeerReceiver); err != nil {
+			return err
+		}
 	} else {
 		id = ""
 	}
-	return app.Render(w, pages.ReceivePage{ID: id})
+	return app.Render(w, pages.ReceivePage{ID: id, CodeLen: app.portal.IDs().MaxLen()})
 }
 
 func (app *App) receivePost(w http.ResponseWriter, r *http.Request) error {
-	id := r.FormValue("id")
+	id := strings.TrimSpace(r.FormValue("id"))
+	if err := app.joinConnection(id, r.FormValue("passphrase")); err != nil {
+		return err
+	}
+	// set peer cookie
+	if err := app.setSession(w, id, PeerReceiver); err != nil {
+		return err
+	}
+	if err := app.RenderAssociated(w, pages.ReceiveForm{ID: id, CodeLen: app.portal.IDs().MaxLen()}); err != nil {
+		return err
+	}
+	// send activity connector oob partial
+	return app.RenderAssociated(w, partials.ActivityConnector{ID: id})
+}
+
+// joinConnection checks that a receiver can join connection id with passphrase.
+func (app *App) joinConnection(id string, passphrase string) error {
 	// get connection
 	conn, err := app.portal.GetConnection(id)
 	if err != nil {
 		desc := "The connection is invalid or expired."
-		if len(id) < idLen {
+		if !app.portal.IDs().Valid(id) {
 			desc = "Invalid connection ID."
 		}
-		if len(id) > idLen && strings.HasPrefix(id, "http") {
+		if strings.HasPrefix(id, "http") {
 			desc = "Invalid connection ID, open the link to join connection."
 		}
 		return NewClientError(err, "Connection not found").
@@ -108,42 +201,41 @@ func (app *App) receivePost(w http.ResponseWriter, r *http.Request) error {
 	}
 	// check if connection is open
 	if !conn.CanEnter(PeerReceiver) {
-		return NewClientError(nil, "Connection not available").
-			WithDesc("Receiver already joined this connection.")
+		desc := "Receiver already joined this connection."
+		switch state := conn.State(); {
+		case state.Final():
+			desc = fmt.Sprintf("The transfer has %s.", state)
+		case state == StateTransferring:
+			desc = "The transfer has already started."
+		}
+		return NewClientError(nil, "Connection not available").WithDesc(desc)
 	}
-	// set peer cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "Session",
-		Value:    PeerReceiver.Pid(id),
-		Path:     fmt.Sprintf("/transfer/%s", id),
-		Expires:  time.Now().Add(time.Hour),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
-	if err = app.RenderAssociated(w, pages.ReceiveForm{ID: id}); err != nil {
-		return err
+	if err = conn.Unlock(passphrase); err != nil {
+		return app.passphraseError(conn, err)
 	}
-	// send activity connector oob partial
-	return app.RenderAssociated(w, partials.ActivityConnector{ID: id})
+	return nil
 }
 
+// transferUpload streams a multipart/form-data upload to the receivers.
+// The first part is a "manifest" field with JSON encoded Headers like the body of a chunked upload,
+// followed by a "file" part for each declared file in the same order.
 func (app *App) transferUpload(w http.ResponseWriter, r *http.Request) error {
 	id := r.PathValue("id")
-	// get peer from cookie
-	cookie, err := r.Cookie("Session")
+	// get peer from bearer token or cookie
+	pid, err := sessionPid(r)
 	if err != nil {
 		return NewClientError(err, "Unauthorized to send").
 			WithDesc("Create a new connection to send.").
 			WithStatus(http.StatusUnauthorized)
 	}
-	peer, err := ParsePeer(id, cookie.Value)
+	token, err := app.portal.Authenticate(id, pid)
 	if err != nil {
 		return NewClientError(err, "Unauthorized to send").
 			WithDesc("Create a new connection to send.").
 			WithStatus(http.StatusUnauthorized)
 	}
 	// verify peer is sender
-	if peer != PeerSender {
+	if token.Peer != PeerSender {
 		return NewClientError(err, "Unauthorized to send").
 			WithDesc("Only sender is allowed to send.").
 			WithStatus(http.StatusUnauthorized)
@@ -155,11 +247,24 @@ func (app *App) transferUpload(w http.ResponseWriter, r *http.Request) error {
 			WithDesc("The connection has expired.").
 			WithStatus(http.StatusNotFound)
 	}
-	// enter connection
-	err = conn.Enter(peer)
+	// handle upload
+	// parts are streamed to receivers as they arrive so nothing is buffered in memory or on disk,
+	// which is why sizes must be declared up front in a manifest part
+	mr, err := r.MultipartReader()
 	if err != nil {
-		return NewClientError(err, "Connection not available").
-			WithDesc("Sender already joined this connection.")
+		return NewClientError(err, "Upload failed").WithDesc("Files must be uploaded as multipart/form-data.")
+	}
+	headers, err := readManifest(mr)
+	if err != nil {
+		return err
+	}
+	if err = app.validateHeaders(&headers); err != nil {
+		return err
+	}
+
+	// enter connection once the manifest is accepted so a rejected upload can be retried
+	if err = conn.Enter(PeerSender, token.Nonce); err != nil {
+		return enterError(PeerSender, err)
 	}
 	conn.Broadcast(Mssg{Data: "Sender has joined connection"})
 
@@ -168,66 +273,123 @@ func (app *App) transferUpload(w http.ResponseWriter, r *http.Request) error {
 		<-ctx.Done()
 		conn.CloseWriter()
 	}(r.Context(), conn)
-
-	// handle upload
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		return NewClientError(err, "Upload failed").WithDesc("Failed to parse uploaded file.")
-	}
-	contentType, err := detectContentType(file)
-	if err != nil {
-		return NewClientError(err, "Upload failed").WithDesc("Failed to parse file type.")
+	if manifest, err := json.Marshal(headers); err == nil {
+		conn.Broadcast(Mssg{Event: "manifest", Data: string(manifest)})
 	}
 	conn.Broadcast(Mssg{Data: "Waiting to upload"})
-	conn.SendHeaders(Headers{ContentType: contentType, FileHeader: header})
+	if err = conn.SendHeaders(r.Context(), headers); err != nil {
+		if errors.Is(err, ErrConnEnded) {
+			return enterError(PeerSender, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return NewClientError(err, "Upload failed").
+				WithDesc("Timed out waiting for a receiver.").
+				WithStatus(http.StatusRequestTimeout)
+		}
+		return NewClientError(err, "Upload failed").
+			WithDesc("Files have already been uploaded to this connection.").
+			WithStatus(http.StatusConflict)
+	}
 	conn.Broadcast(Mssg{Data: "Uploading..."})
 
 	// start goroutine to broadcast upload progress every second
-	go func(ctx context.Context, size int64) {
-		var sum int64 = 0
-		ticker := time.NewTicker(time.Second * 1)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				percentage := fmt.Sprintf("%.0f%%", (float64(sum)/float64(size))*100)
-				conn.Broadcast(Mssg{Event: "progress", Data: percentage})
-			case progress := <-conn.Progress():
-				sum += int64(progress)
-			case <-ctx.Done():
-				return
+	go app.broadcastProgress(r.Context(), conn, headers.Size())
+
+	for i, file := range headers.Files {
+		if len(headers.Files) > 1 {
+			conn.Broadcast(Mssg{Data: fmt.Sprintf("Uploading %s (%d/%d)", file.Path, i+1, len(headers.Files))})
+		}
+		part, err := mr.NextPart()
+		if err == nil && part.FormName() != "file" {
+			err = fmt.Errorf("unexpected part %q", part.FormName())
+		}
+		if err != nil {
+			conn.fail(err)
+			conn.Broadcast(Mssg{Data: "Upload failed"})
+			return NewClientError(err, "Upload failed").
+				WithDesc(fmt.Sprintf("Expected %d files as declared in the manifest.", len(headers.Files)))
+		}
+		// parts are limited to their declared size which is checked against the policy,
+		// parts of unknown size are limited by the policy
+		limit := file.Size
+		if limit == UnknownSize {
+			limit = app.config.Policy.MaxFileSize
+			if limit <= 0 {
+				limit = math.MaxInt64
 			}
 		}
-	}(r.Context(), header.Size)
-
-	_, err = conn.Send(file)
-	if err != nil {
-		conn.Broadcast(Mssg{Data: "Upload failed"})
-	} else {
-		conn.Broadcast(Mssg{Event: "progress", Data: "100%"})
-		conn.Broadcast(Mssg{Data: "Upload complete"})
+		var body io.Reader = http.MaxBytesReader(w, part, limit)
+		if !headers.Encrypted {
+			if body, err = app.checkContent(conn, file, body); err != nil {
+				if _, ok := err.(ClientError); ok {
+					return err
+				}
+				conn.fail(err)
+				conn.Broadcast(Mssg{Data: "Upload failed"})
+				return partError(file, err)
+			}
+		}
+		reader, release := app.throttle.Reader(r.Context(), body, id, clientIP(r, app.config.TrustProxy))
+		_, err = conn.Send(reader)
+		release()
+		if err != nil {
+			if errors.Is(err, ErrChecksumMismatch) {
+				conn.Broadcast(Mssg{Data: fmt.Sprintf("Upload failed, %s does not match its checksum", file.Path)})
+			} else {
+				conn.Broadcast(Mssg{Data: "Upload failed"})
+			}
+			return sendError(file, err)
+		}
+		if _, err = io.Copy(io.Discard, body); err != nil {
+			conn.fail(err)
+			conn.Broadcast(Mssg{Data: "Upload failed"})
+			return partError(file, err)
+		}
+	}
+	conn.Broadcast(Mssg{Event: "progress", Data: "100%"})
+	conn.Broadcast(Mssg{Data: "Upload complete"})
+	if conn.Mode() == ModeStore {
+		conn.Broadcast(Mssg{Data: fmt.Sprintf("Files are available to download for %s", humanDuration(app.portal.StoredFor(conn)))})
 	}
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+// broadcastProgress broadcasts the progress every second followed by the rate over the last second.
+func (app *App) broadcastProgress(ctx context.Context, conn *Conn, size int64) {
+	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
+	last := conn.Progress()
+	for {
+		select {
+		case <-ticker.C:
+			progress := conn.Progress()
+			rate := progress - last
+			last = progress
+			conn.Broadcast(Mssg{Event: "progress", Data: percentage(progress, size) + " " + humanRate(rate)})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (app *App) transferDownload(w http.ResponseWriter, r *http.Request) error {
 	id := r.PathValue("id")
-	// get peer from cookie
-	cookie, err := r.Cookie("Session")
+	// get peer from bearer token or cookie
+	pid, err := sessionPid(r)
 	if err != nil {
 		return NewClientError(err, "Unauthorized to receive").
 			WithDesc("Join a connection to receive.").
 			WithStatus(http.StatusUnauthorized)
 	}
-	peer, err := ParsePeer(id, cookie.Value)
+	token, err := app.portal.Authenticate(id, pid)
 	if err != nil {
 		return NewClientError(err, "Unauthorized to receive").
 			WithDesc("Join a connection to receive.").
 			WithStatus(http.StatusUnauthorized)
 	}
 	// verify peer is receiver
-	if peer != PeerReceiver {
+	if token.Peer != PeerReceiver {
 		return NewClientError(err, "Unauthorized to receive").
 			WithDesc("Only receiver is allowed to receive.").
 			WithStatus(http.StatusUnauthorized)
@@ -240,37 +402,299 @@ func (app *App) transferDownload(w http.ResponseWriter, r *http.Request) error {
 			WithStatus(http.StatusNotFound)
 	}
 	// enter connection
-	err = conn.Enter(peer)
+	released := conn.Released()
+	if err = conn.Enter(PeerReceiver, token.Nonce); err != nil {
+		return enterError(PeerReceiver, err)
+	}
+	// receivers removed by the sender stop waiting right away
+	ctx, cancel := releasedContext(r.Context(), released)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// handle broadcast download
+	if conn.Mode() == ModeBroadcast {
+		return app.transferBroadcast(w, r, conn, id)
+	}
+
+	// handle archive download
+	if format := r.URL.Query().Get("archive"); format != "" {
+		if format != "zip" && format != "tar" {
+			return NewClientError(nil, "Download failed").
+				WithDesc(fmt.Sprintf("Unsupported archive format %q.", format))
+		}
+		if !conn.RequestAll() {
+			return NewClientError(nil, "Download failed").
+				WithDesc("Files have already been downloaded individually.").
+				WithStatus(http.StatusConflict)
+		}
+		conn.Broadcast(Mssg{Data: "Receiver has joined connection"})
+
+		// start goroutine to close connection on request end
+		// stored connections are closed when disposed and released receivers leave it to the next receiver
+		go func(ctx context.Context, conn *Conn) {
+			<-ctx.Done()
+			if conn.Mode() != ModeStore && !isClosed(released) {
+				conn.CloseReader()
+			}
+		}(r.Context(), conn)
+
+		conn.Broadcast(Mssg{Data: "Waiting to download"})
+		headers, err := conn.ReceiveHeaders(r.Context())
+		if err != nil {
+			return uploadFailedError(err)
+		}
+		return app.transferArchive(w, r, conn, id, format, headers, conn.Receive)
+	}
+
+	// handle download
+	var index int
+	if path := r.PathValue("index"); path != "" {
+		if index, err = strconv.Atoi(path); err != nil || index < 0 {
+			return NewClientError(err, "File not found").
+				WithDesc("Invalid file index.").
+				WithStatus(http.StatusNotFound)
+		}
+		// streamed files are rejected right away instead of waiting for their turn
+		if err = conn.RequestFile(index); err != nil {
+			return NewClientError(err, "Download failed").
+				WithDesc("Files must be downloaded once and in order.").
+				WithStatus(http.StatusConflict)
+		}
+	} else {
+		index = conn.NextFile()
+	}
+	if index == 0 {
+		conn.Broadcast(Mssg{Data: "Receiver has joined connection"})
+		conn.Broadcast(Mssg{Data: "Waiting to download"})
+	}
+	headers, err := conn.ReceiveHeaders(r.Context())
 	if err != nil {
-		return NewClientError(err, "Connection not available").
-			WithDesc("Receiver already joined this connection.")
+		return uploadFailedError(err)
+	}
+	if index < 0 || index >= len(headers.Files) {
+		return NewClientError(nil, "File not found").
+			WithDesc("All files have been received.").
+			WithStatus(http.StatusNotFound)
+	}
+	if conn.Mode() == ModeStore && conn.Received(index) {
+		return NewClientError(nil, "File not available").
+			WithDesc("The file has already been downloaded.").
+			WithStatus(http.StatusGone)
+	}
+	file := headers.Files[index]
+	if conn.Mode() == ModeStore {
+		return app.transferStored(w, r, conn, id, headers, index)
 	}
-	conn.Broadcast(Mssg{Data: "Receiver has joined connection"})
 
 	// start goroutine to close connection on request end
+	// connection is kept open until the last file is received, or for the next receiver once released
 	go func(ctx context.Context, conn *Conn) {
 		<-ctx.Done()
-		conn.CloseReader()
+		if isClosed(released) {
+			return
+		}
+		if !conn.Received(index) || index == len(headers.Files)-1 {
+			conn.CloseReader()
+		}
 	}(r.Context(), conn)
 
-	// handle download
-	conn.Broadcast(Mssg{Data: "Waiting to download"})
-	headers := conn.ReceiveHeaders()
-	w.Header().Add("Content-Type", headers.ContentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", headers.Filename))
-	w.Header().Add("Content-Length", fmt.Sprint(headers.Size))
-	conn.Broadcast(Mssg{Data: "Downloading..."})
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Add("Content-Type", file.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(file.Filename))
+	setEncryptedFile(w, headers, index)
+	declareDigest(w)
+	if len(headers.Files) > 1 {
+		conn.Broadcast(Mssg{Data: fmt.Sprintf("Downloading %s (%d/%d)", file.Path, index+1, len(headers.Files))})
+	} else {
+		conn.Broadcast(Mssg{Data: "Downloading..."})
+	}
 
-	_, err = conn.Receive(w)
+	_, err = conn.Receive(r.Context(), w, index)
 	if err != nil {
+		abortOnMismatch(conn, err)
 		conn.Broadcast(Mssg{Data: "Download failed"})
+		return nil
+	}
+	if sum, ok := conn.Checksum(index); ok {
+		setDigest(w.Header(), sum)
+	}
+	conn.Broadcast(Mssg{Data: "Download complete"})
+	return nil
+}
+
+// transferStored serves a file of a connection in store mode.
+// Range and If-Range requests are supported so interrupted downloads can be resumed,
+// the file is only marked as received once all of it has been served without gaps.
+func (app *App) transferStored(w http.ResponseWriter, r *http.Request, conn *Conn, id string, headers Headers, index int) error {
+	blob, err := conn.OpenStored(index)
+	if err != nil {
+		return NewClientError(err, "File not available").
+			WithDesc("The file has already been downloaded.").
+			WithStatus(http.StatusGone)
+	}
+	defer blob.Close()
+	info, err := blob.Stat()
+	if err != nil {
+		return err
+	}
+	file, count := headers.Files[index], len(headers.Files)
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(file.Filename))
+	setEncryptedFile(w, headers, index)
+	// stored files are verified before they can be downloaded so the checksum is known up front
+	if sum, ok := conn.Checksum(index); ok {
+		setDigest(w.Header(), sum)
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d-%x"`, id, index, info.ModTime().UnixNano()))
+
+	if r.Header.Get("Range") == "" {
+		if count > 1 {
+			conn.Broadcast(Mssg{Data: fmt.Sprintf("Downloading %s (%d/%d)", file.Path, index+1, count)})
+		} else {
+			conn.Broadcast(Mssg{Data: "Downloading..."})
+		}
 	} else {
+		conn.Broadcast(Mssg{Data: fmt.Sprintf("Resuming download of %s", file.Path)})
+	}
+
+	content := &rangeTracker{ReadSeeker: blob, ctx: r.Context()}
+	tw, release := app.throttle.ResponseWriter(r.Context(), w, id, clientIP(r, app.config.TrustProxy))
+	defer release()
+	cw := &countingWriter{ResponseWriter: tw}
+	http.ServeContent(cw, r, file.Filename, info.ModTime(), content)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	// a single range response serves the bytes from where reading started,
+	// the body of a multipart response also contains part headers so it is not counted
+	single := !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges")
+	served := (cw.status == http.StatusOK || cw.status == http.StatusPartialContent) && single
+	if served && conn.MarkServed(index, content.start, content.start+cw.written, info.Size()) {
 		conn.Broadcast(Mssg{Data: "Download complete"})
+	} else if cw.status < http.StatusBadRequest {
+		conn.Broadcast(Mssg{Data: "Download interrupted"})
+	}
+	return nil
+}
+
+// transferBroadcast streams the whole transfer to one of many receivers of a broadcast connection.
+// A single file is sent as is while multiple files are always sent as an archive,
+// a tar archive when they are end-to-end encrypted since clients decrypt its entries as they are read.
+func (app *App) transferBroadcast(w http.ResponseWriter, r *http.Request, conn *Conn, id string) error {
+	if r.PathValue("index") != "" {
+		return NewClientError(nil, "Download failed").
+			WithDesc("Files can not be downloaded individually from a broadcast.")
+	}
+	recv, err := conn.Attach()
+	if err != nil {
+		return NewClientError(err, "Connection not available").
+			WithDesc("The transfer has already started.").
+			WithStatus(http.StatusConflict)
+	}
+	conn.Broadcast(Mssg{Data: "Receiver has joined connection"})
+
+	// start goroutine to detach receiver on request end
+	go func(ctx context.Context, conn *Conn) {
+		<-ctx.Done()
+		conn.Detach(recv)
+	}(r.Context(), conn)
+
+	conn.Broadcast(Mssg{Data: "Waiting to download"})
+	headers, err := conn.ReceiveHeaders(r.Context())
+	if err != nil {
+		return uploadFailedError(err)
+	}
+	receive := func(ctx context.Context, w io.Writer, index int) (int64, error) {
+		n, err := copySize(w, recv, headers.Files[index].Size)
+		if err == nil {
+			_, err = conn.Verified(ctx, index)
+		}
+		return n, err
+	}
+	format := r.URL.Query().Get("archive")
+	if len(headers.Files) > 1 || format != "" {
+		if format == "" {
+			format = "zip"
+			if headers.Encrypted {
+				format = "tar"
+			}
+		}
+		return app.transferArchive(w, r, conn, id, format, headers, receive)
+	}
+
+	file := headers.Files[0]
+	w.Header().Add("Content-Type", file.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(file.Filename))
+	setEncryptedFile(w, headers, 0)
+	declareDigest(w)
+	conn.Broadcast(Mssg{Data: "Downloading..."})
+
+	if _, err = receive(r.Context(), w, 0); err != nil {
+		if errors.Is(err, ErrSlowReceiver) {
+			log.Println("dropped slow receiver from connection", id)
+		}
+		abortOnMismatch(conn, err)
+		conn.Broadcast(Mssg{Data: "Download failed"})
+		return nil
+	}
+	if sum, ok := conn.Checksum(0); ok {
+		setDigest(w.Header(), sum)
 	}
+	conn.Broadcast(Mssg{Data: "Download complete"})
+	return nil
+}
+
+// transferArchive streams all files into a single archive as they are received using receive.
+func (app *App) transferArchive(w http.ResponseWriter, r *http.Request, conn *Conn, id string, format string, headers Headers, receive func(context.Context, io.Writer, int) (int64, error)) error {
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		w.Header().Add("Content-Type", "application/zip")
+		archive = newZipArchive(w)
+	case "tar":
+		// tar entries start with their size
+		if headers.Size() == UnknownSize {
+			return NewClientError(nil, "Download failed").
+				WithDesc("Files of unknown size can only be downloaded as zip or on their own.").
+				WithStatus(http.StatusConflict)
+		}
+		w.Header().Add("Content-Type", "application/x-tar")
+		archive = newTarArchive(w)
+	default:
+		return NewClientError(nil, "Download failed").
+			WithDesc(fmt.Sprintf("Unsupported archive format %q.", format))
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(id+"."+format))
+	setEncrypted(w, headers)
+	conn.Broadcast(Mssg{Data: fmt.Sprintf("Downloading %d files as archive...", len(headers.Files))})
+
+	// files are archived as they are received, nothing is buffered beyond the archive writer
+	for i, file := range headers.Files {
+		fw, err := archive.Create(file)
+		if err == nil {
+			_, err = receive(r.Context(), fw, i)
+		}
+		if err != nil {
+			abortOnMismatch(conn, err)
+			conn.Broadcast(Mssg{Data: "Download failed"})
+			return nil
+		}
+	}
+	if err := archive.Close(); err != nil {
+		conn.Broadcast(Mssg{Data: "Download failed"})
+		return nil
+	}
+	conn.Broadcast(Mssg{Data: "Download complete"})
 	return nil
 }
 
 func (app *App) transferEvents(w http.ResponseWriter, r *http.Request) error {
+	return app.streamEvents(w, r, app.mssgToHTML)
+}
+
+// streamEvents streams the messages of a connection to a peer, render formats the data of each message.
+func (app *App) streamEvents(w http.ResponseWriter, r *http.Request, render func(id string, peer Peer, mssg Mssg) string) error {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -278,19 +702,20 @@ func (app *App) transferEvents(w http.ResponseWriter, r *http.Request) error {
 	rc.Flush()
 
 	id := r.PathValue("id")
-	// get peer from cookie
-	cookie, err := r.Cookie("Session")
+	// get peer from bearer token or cookie
+	pid, err := sessionPid(r)
 
 	// close connection on error to prevent client from reconnecting
 	if err != nil {
 		fmt.Fprint(w, Mssg{Event: "close", Data: "Unauthorized"})
 		return nil
 	}
-	peer, err := ParsePeer(id, cookie.Value)
+	token, err := app.portal.Authenticate(id, pid)
 	if err != nil {
 		fmt.Fprint(w, Mssg{Event: "close", Data: "Unauthorized"})
 		return nil
 	}
+	peer := token.Peer
 	// get connection
 	conn, err := app.portal.GetConnection(id)
 	if err != nil {
@@ -298,34 +723,134 @@ func (app *App) transferEvents(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	ping := time.NewTicker(time.Second)
-	defer ping.Stop()
+	// reconnecting clients resume after the last message they received
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub := conn.Subscribe(peer, lastID)
+	defer sub.Cancel()
+	// the expiry is sent first so peers can count down the time left
+	expiry := Mssg{Event: "expiry", Data: conn.ExpiresAt().UTC().Format(time.RFC3339), Retry: eventRetry}
+	expiry.Data = render(id, peer, expiry)
+	fmt.Fprint(w, expiry)
+	rc.Flush()
 	for {
 		select {
-		case mssg, ok := <-conn.Mssg(peer):
-			if !ok {
+		case <-sub.Ready():
+			mssgs, err := sub.Next()
+			for _, mssg := range mssgs {
+				mssg.Data = render(id, peer, mssg)
+				fmt.Fprint(w, mssg)
+			}
+			rc.Flush()
+			if err == io.EOF {
 				fmt.Fprint(w, Mssg{Event: "close", Data: "Done"})
 				return nil
 			}
-			mssg.Data = app.mssgToHTML(mssg)
-			fmt.Fprint(w, mssg)
-			rc.Flush()
+			// a dropped subscriber ends the stream without closing so the client reconnects and catches up
+			if err != nil {
+				return nil
+			}
 		case <-r.Context().Done():
 			return nil
-		case <-ping.C:
-			// keep select running every second to skip blocking cases
-			// a default case will do the same thing but too often
-			continue
 		}
 	}
 }
 
-func (app *App) mssgToHTML(mssg Mssg) string {
+// transferKick revokes the session of the receiver that entered so its next requests are rejected
+// and another receiver can enter.
+func (app *App) transferKick(w http.ResponseWriter, r *http.Request) error {
+	conn, _, err := app.senderConn(r)
+	if err != nil {
+		return err
+	}
+	if conn.Mode() == ModeBroadcast {
+		return NewClientError(nil, "Receiver not removed").
+			WithDesc("Receivers of a broadcast can not be removed.").
+			WithStatus(http.StatusConflict)
+	}
+	session := conn.ReceiverSession()
+	if session == "" {
+		return NewClientError(nil, "Receiver not found").
+			WithDesc("No receiver has joined this connection.").
+			WithStatus(http.StatusNotFound)
+	}
+	// the receiver slot is freed even if its token has already expired
+	app.portal.RevokeReceiver(r.PathValue("id"), session)
+	conn.Broadcast(Mssg{Data: "Receiver was removed by the sender"})
+	conn.Release()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// transferQR renders the receive link as a QR code.
+// The key of encrypted transfers never reaches the server so it is not part of the link.
+func (app *App) transferQR(w http.ResponseWriter, r *http.Request) error {
+	if _, _, err := app.senderConn(r); err != nil {
+		return err
+	}
+	link := requestOrigin(r) + "/receive?id=" + url.QueryEscape(r.PathValue("id"))
+	code, err := qr.Encode(link, qr.Medium)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	_, err = io.WriteString(w, code.SVG())
+	return err
+}
+
+// releasedContext returns a context that is canceled with ErrReleased once released is closed.
+func releasedContext(ctx context.Context, released <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-released:
+			cancel(ErrReleased)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// requestOrigin returns the scheme and host the request was made to, including behind a proxy.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func (app *App) mssgToHTML(id string, peer Peer, mssg Mssg) string {
 	var err error
 	var html strings.Builder
 	switch mssg.Event {
+	case "manifest":
+		var headers Headers
+		if err = json.Unmarshal([]byte(mssg.Data), &headers); err != nil {
+			break
+		}
+		files := make([]partials.TransferFile, len(headers.Files))
+		for i, file := range headers.Files {
+			files[i] = partials.TransferFile{Name: file.Path}
+			if file.Size != UnknownSize {
+				files[i].Size = humanSize(file.Size)
+			}
+		}
+		err = app.RenderAssociated(&html, partials.TransferFiles{ID: id, Files: files, Download: peer == PeerReceiver, Encrypted: headers.Encrypted})
+	case "receivers":
+		count, _ := strconv.Atoi(mssg.Data)
+		err = app.RenderAssociated(&html, partials.ActivityReceivers{Count: count})
 	case "progress":
-		err = app.RenderAssociated(&html, partials.ActivityProgress{Progress: mssg.Data})
+		progress, rate, _ := strings.Cut(mssg.Data, " ")
+		err = app.RenderAssociated(&html, partials.ActivityProgress{Progress: progress, Rate: rate})
+	case "checksum":
+		sum, path, _ := strings.Cut(mssg.Data, "  ")
+		err = app.RenderAssociated(&html, partials.ActivityChecksum{Path: path, Sum: sum})
+	case "expiry":
+		err = app.RenderAssociated(&html, partials.ActivityExpiry{ExpiresAt: mssg.Data})
 	default:
 		err = app.RenderAssociated(&html, partials.ActivityItem{Event: mssg.Event, Data: mssg.Data})
 	}
@@ -336,6 +861,60 @@ func (app *App) mssgToHTML(mssg Mssg) string {
 	return regexp.MustCompile(`\s+`).ReplaceAllString(html.String(), " ")
 }
 
+// enterError explains why peer could not enter a connection.
+func enterError(peer Peer, err error) ClientError {
+	if errors.Is(err, ErrConnEnded) {
+		return NewClientError(err, "Connection not available").
+			WithDesc("The transfer has already ended.").
+			WithStatus(http.StatusGone)
+	}
+	desc := "Receiver already joined this connection."
+	if peer == PeerSender {
+		desc = "Sender already joined this connection."
+	}
+	return NewClientError(err, "Connection not available").WithDesc(desc)
+}
+
+// sessionPid returns the peer id of a request from the bearer token or the session cookie.
+func sessionPid(r *http.Request) (string, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, nil
+	}
+	cookie, err := r.Cookie("Session")
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+// setSession issues a peer token and sets it as the session cookie of the connection.
+func (app *App) setSession(w http.ResponseWriter, id string, peer Peer) error {
+	token, err := app.issueToken(id, peer)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Session",
+		Value:    token.Pid(),
+		Path:     fmt.Sprintf("/transfer/%s", id),
+		Expires:  token.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// issueToken issues a peer token for connection id valid for the session TTL.
+func (app *App) issueToken(id string, peer Peer) (PeerToken, error) {
+	token, err := app.portal.IssueToken(id, peer, app.config.SessionTTL)
+	if errors.Is(err, ErrTooManyTokens) {
+		return token, NewClientError(err, "Unable to join connection").
+			WithDesc("Too many receivers have joined this connection, try again later.").
+			WithStatus(http.StatusTooManyRequests)
+	}
+	return token, err
+}
+
 func (app *App) withError(handler func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := handler(w, r)
@@ -347,6 +926,14 @@ func (app *App) withError(handler func(w http.ResponseWriter, r *http.Request) e
 		if cerr, ok := err.(ClientError); ok {
 			message, desc, status = cerr.Message, cerr.Desc, cerr.Status
 		}
+		// scripts like chunked uploads get the same errors as the API
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			cerr := ClientError{error: err, Message: message, Desc: desc, Status: status}
+			if err := writeJSON(w, status, map[string]ClientError{"error": cerr}); err != nil {
+				log.Println(err)
+			}
+			return
+		}
 		if r.Header.Get("HX-Request") == "true" {
 			w.Header().Add("HX-Retarget", "#notifications")
 			w.Header().Add("HX-Reswap", "afterbegin")
@@ -362,15 +949,198 @@ func (app *App) withError(handler func(w http.ResponseWriter, r *http.Request) e
 	}
 }
 
-func detectContentType(file io.ReadSeeker) (string, error) {
-	buf := make([]byte, 512)
-	n, err := file.Read(buf)
+// withTimeout limits the duration of a transfer by cancelling its context and expiring its connection deadlines.
+// Unlike http.TimeoutHandler the response is not buffered, so transfers stream in constant memory.
+func withTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		// deadlines unblock reads and writes that do not watch the context,
+		// they are reset since the network connection outlives the request
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(timeout)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+		defer rc.SetReadDeadline(time.Time{})
+		defer rc.SetWriteDeadline(time.Time{})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// passphraseError explains a failed passphrase attempt to the receiver and notifies the sender.
+func (app *App) passphraseError(conn *Conn, err error) ClientError {
+	switch {
+	case errors.Is(err, ErrPassphraseRequired):
+		return NewClientError(err, "Passphrase required").
+			WithDesc("Enter the passphrase shared by the sender.").
+			WithStatus(http.StatusUnauthorized)
+	case errors.Is(err, ErrConnLocked):
+		// only the attempt that locked the connection is reported
+		if errors.Is(err, ErrWrongPassphrase) {
+			conn.Broadcast(Mssg{Data: "Connection locked after too many wrong passphrases"})
+		}
+		return NewClientError(err, "Connection locked").
+			WithDesc("Too many wrong passphrases were entered.").
+			WithStatus(http.StatusLocked)
+	case errors.Is(err, ErrWrongPassphrase):
+		conn.Broadcast(Mssg{Data: "A receiver entered a wrong passphrase"})
+		return NewClientError(err, "Wrong passphrase").
+			WithDesc(fmt.Sprintf("The connection locks after %d wrong attempts.", maxPassphraseFails)).
+			WithStatus(http.StatusUnauthorized)
+	default:
+		return NewClientError(err, "Too many attempts").
+			WithDesc("Wait a few seconds before trying again.").
+			WithStatus(http.StatusTooManyRequests)
+	}
+}
+
+func uploadFailedError(err error) ClientError {
+	if errors.Is(err, ErrReleased) {
+		return NewClientError(err, "Download failed").
+			WithDesc("You were removed from the connection by the sender.").
+			WithStatus(http.StatusForbidden)
+	}
+	if errors.Is(err, ErrConnEnded) {
+		return NewClientError(err, "Download failed").
+			WithDesc("The connection closed before the sender uploaded the files.").
+			WithStatus(http.StatusGone)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return NewClientError(err, "Download failed").
+			WithDesc("Timed out waiting for the sender.").
+			WithStatus(http.StatusRequestTimeout)
+	}
+	return NewClientError(err, "Download failed").
+		WithDesc("The sender failed to upload the files.").
+		WithStatus(http.StatusGone)
+}
+
+// sendError explains a failure to send file to the connection.
+func sendError(file FileHeader, err error) ClientError {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return NewClientError(err, "Upload failed").
+			WithDesc(fmt.Sprintf("%s does not match its checksum.", file.Path)).
+			WithStatus(http.StatusUnprocessableEntity)
+	case errors.As(err, &maxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return partError(file, err)
+	default:
+		return NewClientError(err, "Upload failed").
+			WithDesc("The transfer ended before all files were sent.").
+			WithStatus(http.StatusGone)
+	}
+}
+
+// partError explains a failure to read the part of file in a multipart upload.
+func partError(file FileHeader, err error) ClientError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) && file.Size == UnknownSize {
+		return fileTooLargeError(file.Path, maxErr.Limit)
+	}
+	if errors.As(err, &maxErr) {
+		return NewClientError(err, "Upload failed").
+			WithDesc(fmt.Sprintf("%s is larger than its declared size.", file.Path)).
+			WithStatus(http.StatusRequestEntityTooLarge)
+	}
+	return NewClientError(err, "Upload failed").WithDesc("Failed to read uploaded files.")
+}
+
+// readManifest reads the JSON encoded Headers of the manifest part that starts a multipart upload.
+func readManifest(mr *multipart.Reader) (Headers, error) {
+	part, err := mr.NextPart()
+	if err == nil && part.FormName() != "manifest" {
+		err = fmt.Errorf("unexpected part %q", part.FormName())
+	}
 	if err != nil {
-		return "", err
+		return Headers{}, NewClientError(err, "Upload failed").WithDesc("The upload must start with a manifest of the files.")
 	}
-	buf = buf[:n]
-	if _, err := file.Seek(0, 0); err != nil {
-		return "", err
+	defer part.Close()
+	var headers Headers
+	if err := json.NewDecoder(io.LimitReader(part, 1<<20)).Decode(&headers); err != nil {
+		return Headers{}, NewClientError(err, "Upload failed").WithDesc("Failed to parse uploaded files.")
+	}
+	return headers, nil
+}
+
+// setEncrypted marks the download of end-to-end encrypted files so clients know to decrypt it.
+// Archives are marked when their entries are encrypted, each entry is decrypted with its index in the archive,
+// unlike single files they have no X-File-Index.
+func setEncrypted(w http.ResponseWriter, headers Headers) {
+	if headers.Encrypted {
+		w.Header().Set("X-Encrypted", "true")
+	}
+}
+
+// setEncryptedFile marks the download of the end-to-end encrypted file at index,
+// the index is needed to decrypt it.
+func setEncryptedFile(w http.ResponseWriter, headers Headers, index int) {
+	if headers.Encrypted {
+		w.Header().Set("X-Encrypted", "true")
+		w.Header().Set("X-File-Index", strconv.Itoa(index))
 	}
-	return http.DetectContentType(buf), nil
 }
+
+// parseChecksum returns a hex encoded SHA-256 checksum in lower case, an empty checksum is not verified.
+func parseChecksum(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", NewClientError(err, "Upload failed").WithDesc("Invalid SHA-256 checksum.")
+	}
+	return s, nil
+}
+
+// declareDigest announces the checksum trailers of a streamed download.
+// Trailers require a chunked response so no Content-Length is set,
+// which also lets an aborted response be told apart from a complete one.
+func declareDigest(w http.ResponseWriter) {
+	w.Header().Set("Trailer", "Repr-Digest, Digest")
+}
+
+// setDigest sets the checksum in the Repr-Digest (RFC 9530) and the legacy Digest (RFC 3230) fields.
+func setDigest(h http.Header, sum []byte) {
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	h.Set("Digest", "sha-256="+b64)
+}
+
+// abortOnMismatch aborts a download that failed verification, ending it normally would deliver the corrupt bytes as complete.
+func abortOnMismatch(conn *Conn, err error) {
+	if errors.Is(err, ErrChecksumMismatch) {
+		conn.Broadcast(Mssg{Data: "Download failed, the file does not match its checksum"})
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func percentage(n, size int64) string {
+	if size <= 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.0f%%", (float64(n)/float64(size))*100)
+}
+
+// countingWriter records the status code and number of body bytes written to a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	cw.status = status
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"time"
+)
+
+// archiveWriter writes files into an archive stream.
+// The writer returned by Create is valid until the next call to Create or Close.
+type archiveWriter interface {
+	Create(file FileHeader) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func newZipArchive(w io.Writer) *zipArchive {
+	return &zipArchive{zw: zip.NewWriter(w)}
+}
+
+func (a *zipArchive) Create(file FileHeader) (io.Writer, error) {
+	return a.zw.CreateHeader(&zip.FileHeader{
+		Name:     file.Path,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+func (a *zipArchive) Close() error { return a.zw.Close() }
+
+type tarArchive struct {
+	tw *tar.Writer
+}
+
+func newTarArchive(w io.Writer) *tarArchive {
+	return &tarArchive{tw: tar.NewWriter(w)}
+}
+
+func (a *tarArchive) Create(file FileHeader) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.Path,
+		Size:     file.Size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	})
+	return a.tw, err
+}
+
+func (a *tarArchive) Close() error { return a.tw.Close() }
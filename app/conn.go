@@ -1,150 +1,919 @@
 package app
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"mime/multipart"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+var (
+	ErrFileOrder        = errors.New("files must be sent in order")
+	ErrOffsetMismatch   = errors.New("upload offset does not match")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrReleased         = errors.New("receiver was removed by the sender")
+)
+
+// UnknownSize is the size of a file the sender streams without declaring its size.
+const UnknownSize = -1
+
+type FileHeader struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+	// Size is UnknownSize when it is left out, only the last file of a multipart upload can have an unknown size.
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// SHA256 is the hex encoded checksum the sender expects, the transfer fails if the sent bytes do not match.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func (f *FileHeader) UnmarshalJSON(b []byte) error {
+	type fileHeader FileHeader
+	file := fileHeader{Size: UnknownSize}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return err
+	}
+	*f = FileHeader(file)
+	return nil
+}
+
+// Headers is the manifest of all files sent over a connection in the order they are sent.
 type Headers struct {
-	*multipart.FileHeader
-	ContentType string
+	Files []FileHeader `json:"files"`
+	// Encrypted is set when files are end-to-end encrypted, sizes are then the size of the encrypted stream.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// Size returns the total size of all files, or UnknownSize if the size of a file is unknown.
+func (h Headers) Size() int64 {
+	var size int64
+	for _, file := range h.Files {
+		if file.Size == UnknownSize {
+			return UnknownSize
+		}
+		size += file.Size
+	}
+	return size
 }
 
-type Handle struct {
-	mssg    chan Mssg
-	once    sync.Once
-	wg      sync.WaitGroup
-	entered atomic.Bool
+type ConnMode string
+
+const (
+	// ModeDirect pipes the sender stream to a single receiver.
+	ModeDirect ConnMode = "direct"
+	// ModeBroadcast tees the sender stream to every receiver that joins before the upload starts.
+	ModeBroadcast ConnMode = "broadcast"
+	// ModeStore spools the sender stream to a blob store so the receiver can download after the sender leaves.
+	ModeStore ConnMode = "store"
+)
+
+func ParseConnMode(s string) (ConnMode, error) {
+	switch mode := ConnMode(s); mode {
+	case "":
+		return ModeDirect, nil
+	case ModeDirect, ModeBroadcast, ModeStore:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid connection mode %q", s)
+}
+
+type ConnOptions struct {
+	Mode ConnMode
+	// Passphrase is required from receivers when set.
+	Passphrase *Passphrase
+	// Expiry is how long the connection is kept after it is created.
+	Expiry time.Duration
+	// MinReceivers is how many receivers a broadcast waits for before it starts, at least one.
+	MinReceivers int
 }
 
 type Conn struct {
-	pr         *io.PipeReader
-	pw         *io.PipeWriter
-	headers    chan Headers
-	progress   chan int64
-	joined     chan struct{}
-	joinedOnce sync.Once
-	sender     *Handle
-	receiver   *Handle
+	id          string
+	opts        ConnOptions
+	store       BlobStore
+	pr          *io.PipeReader
+	pw          *io.PipeWriter
+	fan         *fanout
+	waiting     chan struct{}
+	waitingOnce sync.Once
+	ready       chan struct{}
+	readyOnce   sync.Once
+	headersSent chan struct{}
+	sendLock    chan struct{}
+	progress    atomic.Int64
+	joined      chan struct{}
+	joinedOnce  sync.Once
+	sender      *Handle
+	receiver    *Handle
+	broadcastMu sync.Mutex
+	seq         uint64
+	history     history
+	created     time.Time
+	active      atomic.Int64
+
+	// stateMu guards the state and who entered, it is never held while taking mu
+	stateMu         sync.Mutex
+	state           ConnState
+	changed         time.Time
+	senderJoined    bool
+	receiverSession string
+	released        chan struct{}
+
+	mu        sync.Mutex
+	manifest  *Headers
+	err       error
+	requested int
+	all       bool
+	next      int
+	busy      bool
+	turn      chan struct{}
+	offsets   []int64
+	sending   int
+	blob      io.WriteCloser
+	hash      hash.Hash
+	checksums [][]byte
+	checked   []chan struct{}
+	received  map[int]bool
+	served    map[int]int64
+	stored    time.Time
+	done      chan struct{}
+	doneOnce  sync.Once
 }
 
-func NewConn() *Conn {
+// NewConn creates a connection, store is only used by connections in store mode.
+func NewConn(id string, opts ConnOptions, store BlobStore) *Conn {
 	pr, pw := io.Pipe()
-	return &Conn{
-		pr:       pr,
-		pw:       pw,
-		headers:  make(chan Headers),
-		progress: make(chan int64),
-		joined:   make(chan struct{}),
-		sender:   &Handle{mssg: make(chan Mssg)},
-		receiver: &Handle{mssg: make(chan Mssg)},
+	now := time.Now()
+	c := &Conn{
+		id:          id,
+		opts:        opts,
+		store:       store,
+		pr:          pr,
+		pw:          pw,
+		waiting:     make(chan struct{}),
+		ready:       make(chan struct{}),
+		headersSent: make(chan struct{}),
+		sendLock:    make(chan struct{}, 1),
+		joined:      make(chan struct{}),
+		sender:      newHandle(),
+		receiver:    newHandle(),
+		created:     now,
+		state:       StateCreated,
+		changed:     now,
+		released:    make(chan struct{}),
+		turn:        make(chan struct{}),
+		received:    make(map[int]bool),
+		served:      make(map[int]int64),
+		done:        make(chan struct{}),
+	}
+	c.active.Store(now.UnixNano())
+	if opts.Mode == ModeBroadcast {
+		c.fan = newFanout(func(*sink) {
+			c.Broadcast(Mssg{Data: "A slow receiver was dropped"})
+			c.Broadcast(Mssg{Event: "receivers", Data: fmt.Sprint(c.fan.Len())})
+		})
 	}
+	return c
 }
 
-func (c *Conn) Enter(peer Peer) error {
+// Enter joins peer to the connection, session is the nonce of the peer token.
+// Only one sender can enter. Any number of receivers can enter a broadcast, in other modes
+// only the first receiver session can enter and it enters again for each file it requests.
+func (c *Conn) Enter(peer Peer, session string) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state.Final() {
+		return ErrConnEnded
+	}
 	switch peer {
 	case PeerSender:
-		if c.sender.entered.Load() {
+		if c.senderJoined {
 			return fmt.Errorf("sender already joined connection")
 		}
-		c.joinedOnce.Do(func() { close(c.joined) })
-		return nil
+		c.senderJoined = true
+		if c.state == StateCreated {
+			c.transitionLocked(StateSenderJoined)
+		}
 	case PeerReceiver:
-		if c.receiver.entered.Load() {
-			return fmt.Errorf("receiver already joined connection")
+		if c.opts.Mode != ModeBroadcast {
+			if c.receiverSession != "" && c.receiverSession != session {
+				return fmt.Errorf("receiver already joined connection")
+			}
+			c.receiverSession = session
 		}
-		c.joinedOnce.Do(func() { close(c.joined) })
-		return nil
+		if c.state == StateCreated || c.state == StateSenderJoined {
+			c.transitionLocked(StateReceiverJoined)
+		}
+	default:
+		return fmt.Errorf("failed to join connection as unknown")
 	}
-	return fmt.Errorf("failed to join connection as unknown")
+	c.joinedOnce.Do(func() { close(c.joined) })
+	c.touch()
+	return nil
 }
 
+// CanEnter reports whether a new peer can enter the connection.
 func (c *Conn) CanEnter(peer Peer) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state.Final() {
+		return false
+	}
 	switch peer {
 	case PeerSender:
-		return !c.sender.entered.Load()
+		return !c.senderJoined
 	case PeerReceiver:
-		return !c.receiver.entered.Load()
+		// receivers can only be attached to a broadcast before the upload starts
+		if c.opts.Mode == ModeBroadcast {
+			return c.state != StateTransferring
+		}
+		return c.receiverSession == ""
 	}
 	return false
 }
 
+// Release removes the receivers that entered the connection after they were revoked, so another receiver can enter.
+// Event streams of the released receivers are ended and their requests are notified through Released.
+// Files requested by released receivers can be requested again until the transfer starts,
+// once it has started a direct transfer is aborted since nobody else can receive the rest of the stream.
+func (c *Conn) Release() {
+	c.stateMu.Lock()
+	c.receiverSession = ""
+	close(c.released)
+	c.released = make(chan struct{})
+	started := c.state == StateTransferring || c.state.Final()
+	c.stateMu.Unlock()
+	c.receiver.release()
+	if !started {
+		c.mu.Lock()
+		c.requested, c.all = 0, false
+		c.mu.Unlock()
+	} else if c.opts.Mode == ModeDirect {
+		c.CloseReader()
+	}
+}
+
+// ReceiverSession returns the session of the receiver that entered a connection not in broadcast mode, if any.
+func (c *Conn) ReceiverSession() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.receiverSession
+}
+
+// Released returns a channel that is closed once the receivers that entered so far are released.
+func (c *Conn) Released() <-chan struct{} {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.released
+}
+
 func (c *Conn) AnyJoined() <-chan struct{} { return c.joined }
 
-func (c *Conn) Mssg(peer Peer) <-chan Mssg {
+// Created returns when the connection was created.
+func (c *Conn) Created() time.Time { return c.created }
+
+// ExpiresAt returns when the connection is disposed even if the transfer has not ended.
+func (c *Conn) ExpiresAt() time.Time { return c.created.Add(c.opts.Expiry) }
+
+// LastActive returns when a peer last entered, changed the state or moved bytes.
+func (c *Conn) LastActive() time.Time { return time.Unix(0, c.active.Load()) }
+
+func (c *Conn) touch() { c.active.Store(time.Now().UnixNano()) }
+
+// Stored returns when all files of a connection in store mode were stored.
+func (c *Conn) Stored() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stored, !c.stored.IsZero()
+}
+
+func (c *Conn) Mode() ConnMode { return c.opts.Mode }
+
+// Protected reports whether receivers must provide a passphrase to join.
+func (c *Conn) Protected() bool { return c.opts.Passphrase != nil }
+
+// Unlock verifies the passphrase of a protected connection.
+func (c *Conn) Unlock(passphrase string) error {
+	if c.opts.Passphrase == nil {
+		return nil
+	}
+	return c.opts.Passphrase.Verify(passphrase)
+}
+
+// Done is closed once all files have been received or the connection is closed.
+func (c *Conn) Done() <-chan struct{} { return c.done }
+
+// HeadersSent is closed once the headers are sent, or the connection ended before they could be.
+func (c *Conn) HeadersSent() <-chan struct{} { return c.headersSent }
+
+// Err returns the error that caused storing files to fail.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Uploaded is closed once the headers are sent or, in store mode, once all files are stored.
+func (c *Conn) Uploaded() <-chan struct{} { return c.ready }
+
+func (c *Conn) finish() { c.doneOnce.Do(func() { close(c.done) }) }
+
+// complete marks the transfer as completed once all files are received.
+func (c *Conn) complete() {
+	c.transition(StateCompleted)
+	c.finish()
+}
+
+// Subscribe returns a subscription to the messages broadcast to peer after the message with ID lastID.
+// Missed messages are replayed from the history of the connection, a lastID of 0 replays the whole history.
+func (c *Conn) Subscribe(peer Peer, lastID uint64) *Subscription {
+	// replaying and subscribing happen between broadcasts so no message is missed or repeated
+	c.broadcastMu.Lock()
+	defer c.broadcastMu.Unlock()
+	replay := c.history.after(lastID)
 	switch peer {
 	case PeerSender:
-		return c.sender.mssg
+		return c.sender.Subscribe(replay)
 	case PeerReceiver:
-		return c.receiver.mssg
+		return c.receiver.Subscribe(replay)
 	default:
-		return nil
+		sub := &Subscription{ready: make(chan struct{}, 1)}
+		sub.close(io.EOF)
+		return sub
 	}
 }
 
+// Broadcast sends m to all peers with the next sequence number of the connection.
 func (c *Conn) Broadcast(m Mssg) {
-	c.sender.wg.Add(1)
-	go func() {
-		defer c.sender.wg.Done()
-		c.sender.mssg <- m
-	}()
-	c.receiver.wg.Add(1)
-	go func() {
-		defer c.receiver.wg.Done()
-		c.receiver.mssg <- m
-	}()
+	c.broadcastMu.Lock()
+	defer c.broadcastMu.Unlock()
+	c.seq++
+	m.ID = c.seq
+	c.history.add(m)
+	c.sender.send(m)
+	c.receiver.send(m)
 }
 
 func (c *Conn) CloseWriter() {
+	if c.fan != nil {
+		c.fan.CloseWithError(nil)
+	}
 	c.pw.Close()
-	c.sender.once.Do(func() {
-		c.sender.wg.Wait()
-		close(c.sender.mssg)
-	})
+	c.sender.close()
 }
 
 func (c *Conn) CloseReader() {
 	c.pr.Close()
-	c.receiver.once.Do(func() {
-		c.receiver.wg.Wait()
-		close(c.receiver.mssg)
-	})
+	c.receiver.close()
 }
 
+// Close closes the connection and deletes any stored files.
+// A connection closed before its transfer ended expires.
 func (c *Conn) Close() {
+	c.transition(StateExpired)
 	c.CloseWriter()
 	c.CloseReader()
+	if c.opts.Mode == ModeStore {
+		c.deleteBlobs()
+	}
+	c.finish()
+}
+
+// Attach adds a receiver to a broadcast connection.
+// Receivers can only be attached before the upload starts.
+func (c *Conn) Attach() (io.Reader, error) {
+	s, err := c.fan.Attach()
+	if err != nil {
+		return nil, err
+	}
+	c.Broadcast(Mssg{Event: "receivers", Data: fmt.Sprint(c.fan.Len())})
+	return s, nil
+}
+
+// Detach removes a receiver from a broadcast connection.
+// The receiver handle is closed once the upload has started and no receivers are left.
+func (c *Conn) Detach(r io.Reader) {
+	s, ok := r.(*sink)
+	if !ok {
+		return
+	}
+	n := c.fan.Detach(s)
+	c.Broadcast(Mssg{Event: "receivers", Data: fmt.Sprint(n)})
+	if n == 0 && c.fan.Started() {
+		c.CloseReader()
+		// receivers leaving before everything is sent fail the upload instead
+		if c.Sent() && c.Err() == nil {
+			c.complete()
+		} else {
+			c.finish()
+		}
+	}
 }
 
-func (c *Conn) SendHeaders(h Headers) { c.headers <- h }
+// Headers returns the headers if they have been sent.
+func (c *Conn) Headers() (Headers, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.manifest == nil {
+		return Headers{}, false
+	}
+	return *c.manifest, true
+}
 
+// SendHeaders waits for a receiver and sends the headers, which starts the transfer.
+// A broadcast waits for MinReceivers receivers, then all attached receivers get the headers and no more receivers can be attached.
+// In store mode SendHeaders does not wait, receivers get the headers once all files are stored.
+// SendHeaders returns ErrConnEnded if the connection ends first, or fails the connection if ctx is done first.
+func (c *Conn) SendHeaders(ctx context.Context, h Headers) error {
+	c.mu.Lock()
+	if c.manifest != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("headers already sent")
+	}
+	c.manifest = &h
+	c.offsets = make([]int64, len(h.Files))
+	c.hash = sha256.New()
+	c.checksums = make([][]byte, len(h.Files))
+	c.checked = make([]chan struct{}, len(h.Files))
+	for i := range c.checked {
+		c.checked[i] = make(chan struct{})
+	}
+	c.mu.Unlock()
+	if c.opts.Mode != ModeStore {
+		select {
+		case <-c.waiting:
+		case <-c.done:
+			return c.endHeaders(ErrConnEnded)
+		case <-ctx.Done():
+			return c.endHeaders(ctx.Err())
+		}
+		if c.fan != nil {
+			c.fan.Start()
+		}
+		c.markReady()
+	}
+	if err := c.transition(StateTransferring); err != nil {
+		return c.endHeaders(fmt.Errorf("%w: %w", ErrConnEnded, err))
+	}
+	close(c.headersSent)
+	return nil
+}
+
+// endHeaders fails a connection that ended before the headers were sent, so chunks waiting for them fail too.
+func (c *Conn) endHeaders(err error) error {
+	c.fail(err)
+	close(c.headersSent)
+	return err
+}
+
+// Send writes the next file to the connection from r.
+// Files must be sent in the same order as they appear in the headers.
+// Unlike SendChunk any failure including a short read fails the connection.
 func (c *Conn) Send(r io.Reader) (written int64, err error) {
-	n, err := io.Copy(c.pw, &ProgressReader{Reader: r, Progress: c.progress})
-	c.pw.CloseWithError(err)
+	c.mu.Lock()
+	index, offset := c.sending, int64(0)
+	if index < len(c.offsets) {
+		offset = c.offsets[index]
+	}
+	c.mu.Unlock()
+	n, err := c.SendChunk(context.Background(), index, offset, r)
+	if size := c.manifest.Files[index].Size; err == nil && size != UnknownSize && c.Offset(index) != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.fail(err)
+	}
 	return n, err
 }
 
-func (c *Conn) ReceiveHeaders() Headers { return <-c.headers }
+// Offset returns the number of bytes sent of the file at index.
+func (c *Conn) Offset(index int) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index >= len(c.offsets) {
+		return 0
+	}
+	return c.offsets[index]
+}
+
+// SendChunk writes the next bytes of the file at index from r until r is drained or the file is complete.
+// Files must be sent in order and offset must be Offset(index), it is checked once no other chunk is being sent
+// so a retried chunk never appends to one that is still being read, ErrOffsetMismatch is returned otherwise.
+// A failure to read r leaves the connection open so the sender can resume from Offset(index),
+// while a failure to write fails the connection.
+func (c *Conn) SendChunk(ctx context.Context, index int, offset int64, r io.Reader) (written int64, err error) {
+	// chunks are sent one at a time
+	select {
+	case c.sendLock <- struct{}{}:
+		defer func() { <-c.sendLock }()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case <-c.headersSent:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	}
+	if index != c.sending || index >= len(c.offsets) {
+		c.mu.Unlock()
+		return 0, ErrFileOrder
+	}
+	if offset != c.offsets[index] {
+		c.mu.Unlock()
+		return 0, ErrOffsetMismatch
+	}
+	// a file of unknown size is read until r ends
+	unknown := c.manifest.Files[index].Size == UnknownSize
+	remaining := c.manifest.Files[index].Size - c.offsets[index]
+	c.mu.Unlock()
+
+	w, err := c.fileWriter(index)
+	if err != nil {
+		c.fail(err)
+		return 0, err
+	}
+	buf := make([]byte, 32*1024)
+	lr := r
+	if !unknown {
+		lr = io.LimitReader(r, remaining)
+	}
+	for {
+		n, rerr := lr.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				c.fail(werr)
+				return written, werr
+			}
+			written += int64(n)
+			c.progress.Add(int64(n))
+			c.touch()
+			c.mu.Lock()
+			c.offsets[index] += int64(n)
+			c.hash.Write(buf[:n])
+			c.mu.Unlock()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	if remaining == written || unknown {
+		if err := c.completeFile(index); err != nil {
+			c.fail(err)
+			return written, err
+		}
+	}
+	if unknown && c.opts.Mode != ModeStore {
+		// the file of unknown size is the last one, receivers read it until the stream ends
+		c.pw.Close()
+		if c.fan != nil {
+			c.fan.CloseWithError(nil)
+		}
+	}
+	return written, nil
+}
+
+// Sent reports whether all files have been sent.
+func (c *Conn) Sent() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.manifest != nil && c.sending == len(c.manifest.Files)
+}
+
+func (c *Conn) fileWriter(index int) (io.Writer, error) {
+	switch {
+	case c.opts.Mode == ModeStore:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.blob == nil {
+			blob, err := c.store.Create(c.blobKey(index))
+			if err != nil {
+				return nil, err
+			}
+			c.blob = blob
+		}
+		return c.blob, nil
+	case c.fan != nil:
+		return c.fan, nil
+	default:
+		return c.pw, nil
+	}
+}
+
+// completeFile verifies the checksum of the file at index and announces it.
+func (c *Conn) completeFile(index int) error {
+	c.mu.Lock()
+	if c.blob != nil {
+		err := c.blob.Close()
+		c.blob = nil
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	file := c.manifest.Files[index]
+	sum := c.hash.Sum(nil)
+	c.hash.Reset()
+	if file.SHA256 != "" && file.SHA256 != hex.EncodeToString(sum) {
+		c.mu.Unlock()
+		return fmt.Errorf("%w for %s", ErrChecksumMismatch, file.Path)
+	}
+	c.checksums[index] = sum
+	close(c.checked[index])
+	c.sending++
+	sent := c.sending == len(c.manifest.Files)
+	if sent && c.opts.Mode == ModeStore {
+		c.stored = time.Now()
+	}
+	c.mu.Unlock()
+	c.Broadcast(Mssg{Event: "checksum", Data: fmt.Sprintf("%x  %s", sum, file.Path)})
+	if sent && c.opts.Mode == ModeStore {
+		c.markReady()
+	}
+	return nil
+}
+
+// Checksum returns the SHA-256 checksum of the file at index once it has been sent.
+func (c *Conn) Checksum(index int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index >= len(c.checksums) || c.checksums[index] == nil {
+		return nil, false
+	}
+	return c.checksums[index], true
+}
+
+// Verified waits until the file at index has been sent and returns its checksum.
+// Receivers of a stream must call it before completing a file since the last bytes are read before they are verified.
+func (c *Conn) Verified(ctx context.Context, index int) ([]byte, error) {
+	c.mu.Lock()
+	if index < 0 || index >= len(c.checked) {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("file not found")
+	}
+	checked := c.checked[index]
+	c.mu.Unlock()
+	select {
+	case <-checked:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if sum, ok := c.Checksum(index); ok {
+		return sum, nil
+	}
+	return nil, c.Err()
+}
 
-func (c *Conn) Receive(w io.Writer) (written int64, err error) {
-	return io.Copy(w, c.pr)
+// fail ends the transfer with err.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.transition(StateFailed)
+	// files not yet sent will never be verified
+	for i := c.sending; i < len(c.checked); i++ {
+		close(c.checked[i])
+	}
+	c.mu.Unlock()
+	c.pw.CloseWithError(err)
+	if c.fan != nil {
+		c.fan.CloseWithError(err)
+	}
+	if c.opts.Mode == ModeStore {
+		c.deleteBlobs()
+		c.markReady()
+	}
 }
 
-func (c *Conn) Progress() <-chan int64 { return c.progress }
+func (c *Conn) markReady() { c.readyOnce.Do(func() { close(c.ready) }) }
 
-type ProgressReader struct {
-	io.Reader
-	Progress chan<- int64
+// ReceiveHeaders waits for the sender headers.
+// Once received the headers are kept, so subsequent calls return immediately.
+// ReceiveHeaders returns an error if the files could not be stored, ErrConnEnded if the connection ends first
+// or the cause of ctx if it is done first.
+func (c *Conn) ReceiveHeaders(ctx context.Context) (Headers, error) {
+	if c.fan == nil || c.fan.Len() >= c.opts.MinReceivers {
+		c.waitingOnce.Do(func() { close(c.waiting) })
+	}
+	select {
+	case <-c.ready:
+	case <-c.done:
+		if !isClosed(c.ready) {
+			return Headers{}, ErrConnEnded
+		}
+	case <-ctx.Done():
+		return Headers{}, context.Cause(ctx)
+	}
+	if err := c.Err(); err != nil {
+		return Headers{}, err
+	}
+	return *c.manifest, nil
 }
 
-func (pr *ProgressReader) Read(p []byte) (int, error) {
-	n, err := pr.Reader.Read(p)
+// NextFile returns the index of the next file to be requested by the receiver.
+// NextFile returns -1 if all files have already been requested.
+// In store mode NextFile returns the first file that has not been received, so interrupted downloads can be resumed.
+func (c *Conn) NextFile() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Mode == ModeStore {
+		for index := 0; c.manifest != nil && index < len(c.manifest.Files); index++ {
+			if !c.received[index] {
+				return index
+			}
+		}
+		return 0
+	}
+	if c.all {
+		return -1
+	}
+	index := c.requested
+	c.requested++
+	return index
+}
+
+// RequestFile marks the file at index as requested by the receiver.
+// Files of a stream can only be requested once and in order, otherwise RequestFile returns ErrFileOrder.
+// In store mode files can be requested in any order.
+func (c *Conn) RequestFile(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Mode == ModeStore {
+		return nil
+	}
+	if c.all || index != c.requested {
+		return ErrFileOrder
+	}
+	c.requested++
+	return nil
+}
+
+// RequestAll marks all files as requested by the receiver.
+// RequestAll returns false if any file has already been requested.
+func (c *Conn) RequestAll() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.all || c.requested > 0 {
+		return false
+	}
+	c.all = true
+	return true
+}
+
+// Received reports whether the file at index has been received.
+func (c *Conn) Received(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Mode == ModeStore {
+		return c.received[index]
+	}
+	return c.next > index
+}
+
+// Receive waits for the file at index to be next in the stream and writes it to w.
+// Files are streamed in order so receiving a file blocks until all files before it are received.
+// In store mode files can be received in any order and each file is deleted after it is received.
+func (c *Conn) Receive(ctx context.Context, w io.Writer, index int) (written int64, err error) {
+	if c.opts.Mode == ModeStore {
+		return c.receiveStored(w, index)
+	}
+	var size int64
+	for {
+		c.mu.Lock()
+		if c.next > index {
+			c.mu.Unlock()
+			return 0, fmt.Errorf("file already received")
+		}
+		if c.next == index && !c.busy {
+			c.busy = true
+			size = c.manifest.Files[index].Size
+			c.mu.Unlock()
+			break
+		}
+		turn := c.turn
+		c.mu.Unlock()
+		select {
+		case <-turn:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	n, err := copySize(w, c.pr, size)
+	if err == nil {
+		_, err = c.Verified(ctx, index)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = false
+	if err == nil {
+		c.next++
+	}
+	if c.next == len(c.manifest.Files) {
+		c.complete()
+	}
+	close(c.turn)
+	c.turn = make(chan struct{})
+	return n, err
+}
+
+// copySize copies size bytes from r to w, or all of r if the size is unknown.
+func copySize(w io.Writer, r io.Reader, size int64) (int64, error) {
+	if size == UnknownSize {
+		return io.Copy(w, r)
+	}
+	return io.CopyN(w, r, size)
+}
+
+func (c *Conn) receiveStored(w io.Writer, index int) (written int64, err error) {
+	blob, err := c.OpenStored(index)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	n, err := io.Copy(w, blob)
 	if err != nil {
 		return n, err
 	}
-	go func() { pr.Progress <- int64(n) }()
-	return n, err
+	c.MarkReceived(index)
+	return n, nil
 }
+
+// OpenStored opens the file at index of a connection in store mode.
+func (c *Conn) OpenStored(index int) (Blob, error) {
+	if c.opts.Mode != ModeStore {
+		return nil, fmt.Errorf("connection is not in store mode")
+	}
+	if c.Received(index) {
+		return nil, fmt.Errorf("file already received")
+	}
+	return c.store.Open(c.blobKey(index))
+}
+
+// MarkReceived marks the file at index of a connection in store mode as received and deletes it.
+func (c *Conn) MarkReceived(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received[index] = true
+	c.store.Delete(c.blobKey(index))
+	if len(c.received) == len(c.manifest.Files) {
+		c.complete()
+	}
+}
+
+// MarkServed records that the bytes from start to end of the stored file at index have been served.
+// Once the file has been served contiguously from its first to its last byte it is marked as received,
+// MarkServed reports whether it was.
+func (c *Conn) MarkServed(index int, start, end, size int64) bool {
+	c.mu.Lock()
+	if start <= c.served[index] && end > c.served[index] {
+		c.served[index] = end
+	}
+	complete := c.served[index] >= size && !c.received[index]
+	c.mu.Unlock()
+	if complete {
+		c.MarkReceived(index)
+	}
+	return complete
+}
+
+func (c *Conn) blobKey(index int) string { return fmt.Sprintf("%s.%d", c.id, index) }
+
+func (c *Conn) deleteBlobs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blob != nil {
+		c.blob.Close()
+		c.blob = nil
+	}
+	for i := 0; i <= c.sending && c.manifest != nil && i < len(c.manifest.Files); i++ {
+		c.store.Delete(c.blobKey(i))
+	}
+}
+
+// Progress returns the number of bytes sent.
+func (c *Conn) Progress() int64 { return c.progress.Load() }
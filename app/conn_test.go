@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStoredConn(t *testing.T, files ...FileHeader) *Conn {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn("abc", ConnOptions{Mode: ModeStore}, store)
+	if err = conn.Enter(PeerSender, "sender"); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SendHeaders(context.Background(), Headers{Files: files}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestSendChunkRetry(t *testing.T) {
+	conn := newStoredConn(t, FileHeader{Filename: "a.txt", Path: "a.txt", Size: 8, ContentType: "text/plain"})
+
+	// the first request is still being read when the client gives up on it and retries
+	pr, pw := io.Pipe()
+	first := make(chan error, 1)
+	go func() {
+		_, err := conn.SendChunk(context.Background(), 0, 0, pr)
+		first <- err
+	}()
+	pw.Write([]byte("abc"))
+	retried := make(chan error, 1)
+	go func() {
+		_, err := conn.SendChunk(context.Background(), 0, 0, strings.NewReader("abcdefgh"))
+		retried <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pw.CloseWithError(io.ErrUnexpectedEOF)
+
+	if err := <-first; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("first chunk: got %v, want the read error", err)
+	}
+	if err := <-retried; !errors.Is(err, ErrOffsetMismatch) {
+		t.Fatalf("retried chunk: got %v, want ErrOffsetMismatch", err)
+	}
+	if _, err := conn.SendChunk(context.Background(), 0, 3, strings.NewReader("defgh")); err != nil {
+		t.Fatalf("resumed chunk: %v", err)
+	}
+
+	blob, err := conn.OpenStored(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	got, _ := io.ReadAll(blob)
+	if string(got) != "abcdefgh" {
+		t.Errorf("stored %q, want %q", got, "abcdefgh")
+	}
+}
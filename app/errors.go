@@ -4,9 +4,9 @@ import "net/http"
 
 type ClientError struct {
 	error
-	Message string
-	Desc    string
-	Status  int
+	Message string `json:"message"`
+	Desc    string `json:"description,omitempty"`
+	Status  int    `json:"status"`
 }
 
 func NewClientError(err error, message string) ClientError {
@@ -23,6 +23,13 @@ func (ce ClientError) WithDesc(desc string) ClientError {
 	return ce
 }
 
+func (ce ClientError) Error() string {
+	if ce.error == nil {
+		return ce.Message
+	}
+	return ce.error.Error()
+}
+
 func (ce ClientError) Unwrap() error {
 	return ce.error
 }
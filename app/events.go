@@ -0,0 +1,196 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriptionBufferSize is the number of messages queued for each subscriber.
+	subscriptionBufferSize = 128
+	// historySize is the number of messages a connection keeps to replay to subscribers.
+	historySize = 512
+	// eventRetry is how long clients wait before reconnecting to a dropped event stream.
+	eventRetry = 3 * time.Second
+)
+
+var ErrSlowSubscriber = errors.New("subscriber is too slow")
+
+// Handle delivers the messages of a connection to the subscribers of one peer.
+// Sending never blocks, every subscriber has a bounded queue that is read in order.
+type Handle struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newHandle() *Handle {
+	return &Handle{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription that receives the replayed messages followed by every message sent to the handle.
+// Call Cancel once done reading.
+func (h *Handle) Subscribe(replay []Mssg) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &Subscription{ready: make(chan struct{}, 1), queue: replay}
+	if len(replay) > 0 {
+		sub.signal()
+	}
+	if h.closed {
+		sub.close(io.EOF)
+		return sub
+	}
+	sub.cancel = func() {
+		h.mu.Lock()
+		delete(h.subs, sub)
+		h.mu.Unlock()
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *Handle) send(m Mssg) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.push(m) {
+			delete(h.subs, sub)
+		}
+	}
+}
+
+// release ends the current subscriptions, later subscriptions still receive messages.
+func (h *Handle) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		sub.close(io.EOF)
+	}
+	clear(h.subs)
+}
+
+func (h *Handle) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		sub.close(io.EOF)
+	}
+	h.subs = nil
+}
+
+// Subscription is the queue of messages of a subscriber.
+type Subscription struct {
+	mu     sync.Mutex
+	queue  []Mssg
+	ready  chan struct{}
+	err    error
+	cancel func()
+}
+
+// Ready is signalled when messages are queued or the subscription is closed.
+func (s *Subscription) Ready() <-chan struct{} { return s.ready }
+
+// Next returns the queued messages in order.
+// Once the queue is drained after the subscription is closed it returns io.EOF,
+// or ErrSlowSubscriber if the subscriber fell too far behind and was dropped.
+func (s *Subscription) Next() ([]Mssg, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mssgs := s.queue
+	s.queue = nil
+	if len(mssgs) > 0 {
+		// report the error with the next call so queued messages are not lost
+		if s.err != nil {
+			s.signal()
+		}
+		return mssgs, nil
+	}
+	return nil, s.err
+}
+
+// Cancel unsubscribes from the handle.
+func (s *Subscription) Cancel() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// push queues m and reports whether the subscription is still open.
+// A full queue first drops its oldest progress message since every progress message supersedes the last,
+// a queue full of other messages closes the subscription instead.
+func (s *Subscription) push(m Mssg) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false
+	}
+	if len(s.queue) >= subscriptionBufferSize {
+		i := 0
+		for i < len(s.queue) && s.queue[i].Event != "progress" {
+			i++
+		}
+		if i == len(s.queue) {
+			s.err = ErrSlowSubscriber
+			s.signal()
+			return false
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	}
+	s.queue = append(s.queue, m)
+	s.signal()
+	return true
+}
+
+func (s *Subscription) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.signal()
+}
+
+// history keeps the messages of a connection so subscribers can catch up on what they missed.
+// Only the latest progress message is kept since it supersedes the others,
+// and the oldest messages are dropped once the history is full.
+type history struct {
+	mssgs []Mssg
+}
+
+func (hs *history) add(m Mssg) {
+	if m.Event == "progress" {
+		for i := len(hs.mssgs) - 1; i >= 0; i-- {
+			if hs.mssgs[i].Event == "progress" {
+				hs.mssgs = append(hs.mssgs[:i], hs.mssgs[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(hs.mssgs) >= historySize {
+		hs.mssgs = hs.mssgs[1:]
+	}
+	hs.mssgs = append(hs.mssgs, m)
+}
+
+// after returns a copy of the messages with an ID greater than id.
+func (hs *history) after(id uint64) []Mssg {
+	i := sort.Search(len(hs.mssgs), func(i int) bool { return hs.mssgs[i].ID > id })
+	return slices.Clone(hs.mssgs[i:])
+}
+
+// signal wakes up the reader without blocking, a pending signal already covers new messages.
+func (s *Subscription) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBroadcastReceivers is the most receivers a sender can wait for before a broadcast starts.
+	maxBroadcastReceivers = 100
+	// sinkBufferSize is the number of chunks buffered for each receiver.
+	sinkBufferSize = 64
+	// slowReceiverTimeout is how long a write waits on a full receiver buffer before dropping the receiver.
+	slowReceiverTimeout = time.Second * 5
+)
+
+var (
+	ErrSlowReceiver     = errors.New("receiver is too slow")
+	ErrTransferStarted  = errors.New("transfer already started")
+	ErrNoReceivers      = errors.New("no receivers left")
+	errFanoutSinkClosed = errors.New("receiver closed")
+)
+
+// fanout tees writes to every attached sink.
+// Each sink has a bounded buffer, a sink that can not keep up is dropped
+// instead of stalling the writer and the other sinks.
+type fanout struct {
+	mu      sync.Mutex
+	sinks   map[*sink]struct{}
+	started bool
+	closed  bool
+	onDrop  func(*sink)
+}
+
+func newFanout(onDrop func(*sink)) *fanout {
+	return &fanout{sinks: make(map[*sink]struct{}), onDrop: onDrop}
+}
+
+// Attach adds a new sink, sinks can only be attached before the first write.
+func (f *fanout) Attach() (*sink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started || f.closed {
+		return nil, ErrTransferStarted
+	}
+	s := &sink{chunks: make(chan []byte, sinkBufferSize), done: make(chan struct{})}
+	f.sinks[s] = struct{}{}
+	return s, nil
+}
+
+// Detach removes a sink and returns the number of sinks left.
+func (f *fanout) Detach(s *sink) int {
+	// close before locking to unblock a write waiting on this sink
+	s.close(errFanoutSinkClosed)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sinks, s)
+	return len(f.sinks)
+}
+
+// Start prevents new sinks from being attached.
+func (f *fanout) Start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = true
+}
+
+func (f *fanout) Started() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.started
+}
+
+func (f *fanout) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sinks)
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = true
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	var full []*sink
+	for s := range f.sinks {
+		select {
+		case s.chunks <- chunk:
+		default:
+			full = append(full, s)
+		}
+	}
+	// slow sinks share a single deadline so one slow sink can not multiply the wait
+	deadline := time.NewTimer(slowReceiverTimeout)
+	defer deadline.Stop()
+	for _, s := range full {
+		select {
+		case s.chunks <- chunk:
+		case <-s.done:
+			delete(f.sinks, s)
+		case <-deadline.C:
+			f.drop(s)
+		}
+	}
+	if len(f.sinks) == 0 {
+		return 0, ErrNoReceivers
+	}
+	return len(p), nil
+}
+
+func (f *fanout) drop(s *sink) {
+	delete(f.sinks, s)
+	s.close(ErrSlowReceiver)
+	if f.onDrop != nil {
+		go f.onDrop(s)
+	}
+}
+
+// CloseWithError closes all sinks, sinks return err after reading all buffered chunks.
+// A nil err closes sinks with io.EOF.
+func (f *fanout) CloseWithError(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for s := range f.sinks {
+		s.finish(err)
+	}
+}
+
+// sink is the reading end of a fanout.
+type sink struct {
+	chunks chan []byte
+	buf    []byte
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (s *sink) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, s.err
+			}
+			s.buf = chunk
+		case <-s.done:
+			return 0, s.err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// finish closes the chunks so the reader drains the buffer before returning err.
+func (s *sink) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.chunks)
+	})
+}
+
+// close stops the reader immediately with err.
+func (s *sink) close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
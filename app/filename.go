@@ -0,0 +1,41 @@
+package app
+
+import (
+	"mime"
+	"strings"
+	"unicode"
+)
+
+// sanitizePath cleans a relative file path sent by a client.
+// Path separators are normalized to "/" and empty, "." and ".." elements are removed
+// so the path can never escape the directory it is extracted into.
+func sanitizePath(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		part = sanitizeFilename(part)
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sanitizeFilename removes path separators and control characters from a filename.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(name)
+}
+
+func contentDisposition(filename string) string {
+	if filename = sanitizeFilename(filename); filename == "" || filename == "." || filename == ".." {
+		filename = "download"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	crypto "crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// IDGenerator generates connection IDs.
+type IDGenerator interface {
+	Generate() (string, error)
+	// Valid reports whether id has the format of generated IDs.
+	Valid(id string) bool
+	// MaxLen returns the maximum length of generated IDs.
+	MaxLen() int
+}
+
+var ErrInvalidIDFormat = errors.New("invalid id format")
+
+const (
+	defaultIDAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	defaultIDLen      = 10
+	defaultNumericLen = 8
+	defaultWordCount  = 3
+	wordIDDigits      = 2
+	minIDLen          = 4
+)
+
+// NewIDGenerator returns the generator for format, one of "alphanumeric", "words" or "numeric".
+// Length is the number of characters, or the number of words for the words format, zero uses the default.
+// Alphabet is only used by the alphanumeric format and must only contain unique ASCII characters.
+func NewIDGenerator(format string, length int, alphabet string) (IDGenerator, error) {
+	switch format {
+	case "", "alphanumeric":
+		return NewAlphanumericIDs(length, alphabet)
+	case "words":
+		return NewWordIDs(length)
+	case "numeric":
+		return NewNumericIDs(length)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrInvalidIDFormat, format)
+	}
+}
+
+// AlphanumericIDs generates IDs of random characters from an alphabet.
+type AlphanumericIDs struct {
+	length   int
+	alphabet string
+}
+
+// NewAlphanumericIDs creates a generator of IDs of length characters from alphabet, which must be ASCII.
+func NewAlphanumericIDs(length int, alphabet string) (*AlphanumericIDs, error) {
+	if length == 0 {
+		length = defaultIDLen
+	}
+	if alphabet == "" {
+		alphabet = defaultIDAlphabet
+	}
+	if length < minIDLen || len(alphabet) < 2 || !isASCII(alphabet) || !uniqueChars(alphabet) {
+		return nil, ErrInvalidIDFormat
+	}
+	return &AlphanumericIDs{length: length, alphabet: alphabet}, nil
+}
+
+func (g *AlphanumericIDs) Generate() (string, error) {
+	return randomString(g.alphabet, g.length)
+}
+
+func (g *AlphanumericIDs) Valid(id string) bool {
+	return len(id) == g.length && containsOnly(id, g.alphabet)
+}
+
+func (g *AlphanumericIDs) MaxLen() int { return g.length }
+
+// NumericIDs generates numeric codes that are easy to enter on TVs and phones.
+type NumericIDs struct {
+	length int
+}
+
+func NewNumericIDs(length int) (*NumericIDs, error) {
+	if length == 0 {
+		length = defaultNumericLen
+	}
+	if length < minIDLen {
+		return nil, ErrInvalidIDFormat
+	}
+	return &NumericIDs{length: length}, nil
+}
+
+func (g *NumericIDs) Generate() (string, error) {
+	return randomString("0123456789", g.length)
+}
+
+func (g *NumericIDs) Valid(id string) bool {
+	return len(id) == g.length && containsOnly(id, "0123456789")
+}
+
+func (g *NumericIDs) MaxLen() int { return g.length }
+
+// WordIDs generates human friendly IDs of adjectives followed by a noun and two digits, like "purple-otter-42".
+type WordIDs struct {
+	words int
+}
+
+func NewWordIDs(words int) (*WordIDs, error) {
+	if words == 0 {
+		words = defaultWordCount
+	}
+	if words < 2 {
+		return nil, ErrInvalidIDFormat
+	}
+	return &WordIDs{words: words}, nil
+}
+
+func (g *WordIDs) Generate() (string, error) {
+	parts := make([]string, g.words+1)
+	for i := range g.words {
+		list := adjectives
+		if i == g.words-1 {
+			list = nouns
+		}
+		n, err := randomInt(len(list))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = list[n]
+	}
+	digits, err := randomString("0123456789", wordIDDigits)
+	if err != nil {
+		return "", err
+	}
+	parts[g.words] = digits
+	return strings.Join(parts, "-"), nil
+}
+
+func (g *WordIDs) Valid(id string) bool {
+	parts := strings.Split(id, "-")
+	if len(parts) != g.words+1 {
+		return false
+	}
+	for i, part := range parts[:g.words] {
+		list := adjectives
+		if i == g.words-1 {
+			list = nouns
+		}
+		if !slices.Contains(list, part) {
+			return false
+		}
+	}
+	digits := parts[g.words]
+	return len(digits) == wordIDDigits && containsOnly(digits, "0123456789")
+}
+
+func (g *WordIDs) MaxLen() int {
+	longest := func(list []string) int {
+		n := 0
+		for _, word := range list {
+			n = max(n, len(word))
+		}
+		return n
+	}
+	return (g.words-1)*(longest(adjectives)+1) + longest(nouns) + 1 + wordIDDigits
+}
+
+func randomInt(n int) (int, error) {
+	i, err := crypto.Int(crypto.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := randomInt(len(alphabet))
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n]
+	}
+	return string(b), nil
+}
+
+func containsOnly(s, chars string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune(chars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isASCII reports whether s only contains ASCII characters, randomString picks characters by byte.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueChars(s string) bool {
+	for i, r := range s {
+		if strings.ContainsRune(s[i+len(string(r)):], r) {
+			return false
+		}
+	}
+	return true
+}
+
+var adjectives = []string{
+	"amber", "bold", "brave", "bright", "brisk", "calm", "clever", "cosmic", "crisp", "curly",
+	"dapper", "daring", "dusty", "eager", "early", "fancy", "fierce", "fluffy", "frosty", "gentle",
+	"giant", "glad", "golden", "grand", "happy", "hidden", "humble", "icy", "jolly", "keen",
+	"kind", "lively", "lucky", "mellow", "merry", "mighty", "misty", "modest", "noble", "odd",
+	"olive", "pale", "plucky", "polite", "proud", "purple", "quick", "quiet", "rapid", "rosy",
+	"royal", "rusty", "shiny", "shy", "silent", "silly", "silver", "sleek", "sleepy", "slow",
+	"smart", "snowy", "soft", "solar", "spicy", "steady", "stormy", "sunny", "super", "swift",
+	"tidy", "tiny", "witty", "young", "zesty",
+}
+
+var nouns = []string{
+	"acorn", "badger", "beacon", "bear", "beaver", "bison", "breeze", "brook", "cactus", "canyon",
+	"cedar", "cloud", "comet", "coral", "crane", "crow", "daisy", "dolphin", "dove", "dragon",
+	"eagle", "falcon", "fern", "finch", "fox", "frog", "gecko", "glacier", "goose", "harbor",
+	"hawk", "heron", "island", "jaguar", "koala", "lake", "lemur", "lily", "lion", "llama",
+	"lotus", "maple", "meadow", "moose", "moth", "newt", "ocean", "orca", "otter", "owl",
+	"panda", "parrot", "pebble", "pelican", "pine", "planet", "pony", "puffin", "quail", "rabbit",
+	"raven", "reef", "river", "robin", "salmon", "seal", "shark", "sparrow", "spruce", "squid",
+	"star", "stone", "swan", "tiger", "toucan", "tulip", "turtle", "valley", "walrus", "whale",
+	"willow", "wolf", "yak", "zebra",
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// janitorInterval is how often the janitor looks for connections to dispose.
+	janitorInterval = 5 * time.Second
+	// endedLinger keeps completed and failed connections for a moment so peers can still read their status.
+	endedLinger = 30 * time.Second
+)
+
+// Timeouts bound how long connections are kept, zero values use the defaults.
+type Timeouts struct {
+	// Unjoined is how long a connection nobody has joined is kept, 5 minutes by default.
+	Unjoined time.Duration
+	// Idle is how long a joined connection is kept without any transfer activity, 15 minutes by default.
+	Idle time.Duration
+	// Lifetime is how long any connection is kept even while transferring, a day by default.
+	// Senders can choose a shorter expiry for their connection.
+	Lifetime time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Unjoined <= 0 {
+		t.Unjoined = 5 * time.Minute
+	}
+	if t.Idle <= 0 {
+		t.Idle = 15 * time.Minute
+	}
+	if t.Lifetime <= 0 {
+		t.Lifetime = 24 * time.Hour
+	}
+	return t
+}
+
+// DisposeReason explains why a connection was disposed.
+type DisposeReason string
+
+const (
+	DisposeCompleted DisposeReason = "completed"
+	DisposeFailed    DisposeReason = "failed"
+	DisposeUnjoined  DisposeReason = "unjoined"
+	DisposeIdle      DisposeReason = "idle"
+	DisposeStoreTTL  DisposeReason = "store-ttl"
+	DisposeExpired   DisposeReason = "expired"
+)
+
+// Message describes the reason to peers of the connection.
+func (r DisposeReason) Message() string {
+	switch r {
+	case DisposeCompleted:
+		return "Connection closed, the transfer has completed"
+	case DisposeFailed:
+		return "Connection closed, the transfer has failed"
+	case DisposeUnjoined:
+		return "Connection closed, nobody joined in time"
+	case DisposeIdle:
+		return "Connection closed, it was idle for too long"
+	case DisposeStoreTTL:
+		return "Connection closed, the stored files have expired"
+	case DisposeExpired:
+		return "Connection closed, it has expired"
+	}
+	return "Connection closed"
+}
+
+// janitor periodically disposes connections that have ended or expired.
+func (p *Portal) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.sweep(now)
+	}
+}
+
+// sweep disposes every connection that should no longer be kept at time now.
+func (p *Portal) sweep(now time.Time) {
+	disposals := make(map[string]DisposeReason)
+	p.mu.RLock()
+	for id, conn := range p.conns {
+		if reason, ok := p.disposeReason(conn, now); ok {
+			disposals[id] = reason
+		}
+	}
+	p.mu.RUnlock()
+	for id, reason := range disposals {
+		p.DisposeConnection(id, reason)
+	}
+}
+
+// disposeReason reports whether conn should be disposed at time now and why.
+func (p *Portal) disposeReason(conn *Conn, now time.Time) (DisposeReason, bool) {
+	state, since := conn.StateSince()
+	switch {
+	case state == StateCompleted && now.Sub(since) >= endedLinger:
+		return DisposeCompleted, true
+	case state == StateFailed && now.Sub(since) >= endedLinger:
+		return DisposeFailed, true
+	case state.Final():
+		return "", false
+	case !now.Before(conn.ExpiresAt()):
+		return DisposeExpired, true
+	case state == StateCreated && now.Sub(conn.Created()) >= p.timeouts.Unjoined:
+		return DisposeUnjoined, true
+	}
+	// stored files wait for the receiver until the ttl instead of timing out while idle
+	if stored, ok := conn.Stored(); ok {
+		if now.Sub(stored) >= p.ttl {
+			return DisposeStoreTTL, true
+		}
+		return "", false
+	}
+	if state != StateCreated && now.Sub(conn.LastActive()) >= p.timeouts.Idle {
+		return DisposeIdle, true
+	}
+	return "", false
+}
+
+// humanDuration formats a duration in its largest whole unit like "10 minutes" or "1 day".
+func humanDuration(d time.Duration) string {
+	for _, unit := range []struct {
+		size time.Duration
+		name string
+	}{{24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}} {
+		if n := d / unit.size; n == 1 {
+			return "1 " + unit.name
+		} else if n > 1 {
+			return fmt.Sprintf("%d %ss", n, unit.name)
+		}
+	}
+	return "less than a minute"
+}
@@ -2,15 +2,27 @@ package app
 
 import (
 	"fmt"
+	"time"
 )
 
 type Mssg struct {
+	// ID is the sequence number of the message in its connection, messages are delivered in order.
+	// Clients resume from it with the Last-Event-ID header, messages without an ID are not replayed.
+	ID    uint64
 	Event string
 	Data  string
+	// Retry tells clients how long to wait before reconnecting.
+	Retry time.Duration
 }
 
 func (m Mssg) String() string {
 	var res string
+	if m.ID != 0 {
+		res = appendMssg(res, fmt.Sprintf("id: %d", m.ID))
+	}
+	if m.Retry > 0 {
+		res = appendMssg(res, fmt.Sprintf("retry: %d", m.Retry.Milliseconds()))
+	}
 	if m.Event != "" {
 		res = appendMssg(res, fmt.Sprintf("event: %s", m.Event))
 	}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"crypto/hmac"
+	crypto "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	minPassphraseLen     = 4
+	maxPassphraseLen     = 128
+	maxPassphraseFails   = 5
+	passphraseIterations = 600_000
+	passphraseSaltLen    = 16
+)
+
+var (
+	ErrInvalidPassphrase  = errors.New("invalid passphrase")
+	ErrPassphraseRequired = errors.New("passphrase required")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+	ErrPassphraseThrottle = errors.New("too many passphrase attempts")
+	ErrConnLocked         = errors.New("connection locked")
+)
+
+// Passphrase protects a connection, only a salted PBKDF2-HMAC-SHA256 hash of it is kept.
+// Wrong attempts are throttled with an exponential delay and the passphrase locks after maxPassphraseFails.
+type Passphrase struct {
+	salt  []byte
+	hash  []byte
+	mu    sync.Mutex
+	fails int
+	next  time.Time
+}
+
+func NewPassphrase(passphrase string) (*Passphrase, error) {
+	if len(passphrase) < minPassphraseLen || len(passphrase) > maxPassphraseLen {
+		return nil, ErrInvalidPassphrase
+	}
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := crypto.Read(salt); err != nil {
+		return nil, err
+	}
+	return &Passphrase{salt: salt, hash: pbkdf2(passphrase, salt, passphraseIterations)}, nil
+}
+
+// Verify checks passphrase, attempts are serialized so guesses can not be made in parallel.
+func (p *Passphrase) Verify(passphrase string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fails >= maxPassphraseFails {
+		return ErrConnLocked
+	}
+	if passphrase == "" {
+		return ErrPassphraseRequired
+	}
+	if time.Now().Before(p.next) {
+		return ErrPassphraseThrottle
+	}
+	if len(passphrase) <= maxPassphraseLen {
+		hash := pbkdf2(passphrase, p.salt, passphraseIterations)
+		if subtle.ConstantTimeCompare(hash, p.hash) == 1 {
+			return nil
+		}
+	}
+	p.fails++
+	if p.fails >= maxPassphraseFails {
+		return errors.Join(ErrWrongPassphrase, ErrConnLocked)
+	}
+	p.next = time.Now().Add(time.Second << (p.fails - 1))
+	return ErrWrongPassphrase
+}
+
+// pbkdf2 derives a single block key as specified in RFC 8018 using HMAC-SHA256.
+func pbkdf2(passphrase string, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, []byte(passphrase))
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		subtle.XORBytes(key, key, u)
+	}
+	return key
+}
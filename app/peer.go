@@ -1,11 +1,13 @@
 package app
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	crypto "crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Peer string
@@ -18,46 +20,97 @@ const (
 // InvalidPeerErr means peer could not be verified due to missing or malformed peer id.
 var ErrInvalidPeer = errors.New("invalid peer id")
 
-func (p Peer) Pid(id string) string {
-	data := id + ":" + string(p)
-	hash := hmac.New(sha256.New, secret)
-	hash.Write([]byte(data))
-	signature := hash.Sum(nil)
-	return base64.URLEncoding.EncodeToString(signature) + "." + base64.URLEncoding.EncodeToString([]byte(data))
+var ErrExpiredPeer = errors.New("expired peer id")
+
+// tokenVersion prefixes peer ids so the format can change without misreading older ids.
+const tokenVersion = "v1"
+
+// maxClockSkew is the tolerance for peer ids issued in the future by another replica.
+const maxClockSkew = time.Minute
+
+// PeerToken is the signed session of a peer in a connection.
+type PeerToken struct {
+	ID        string
+	Peer      Peer
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Nonce     string
+}
+
+// NewPeerToken issues a token for peer in connection id valid for ttl.
+func NewPeerToken(id string, peer Peer, ttl time.Duration) (PeerToken, error) {
+	nonce := make([]byte, 16)
+	if _, err := crypto.Read(nonce); err != nil {
+		return PeerToken{}, err
+	}
+	now := time.Now()
+	return PeerToken{
+		ID:        id,
+		Peer:      peer,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+// Pid returns the peer id of the token signed with the newest key of the keyring.
+// It is formatted as version.keyID.signature.data where data is peer:issuedAt:expiresAt:nonce:id.
+func (t PeerToken) Pid() string {
+	data := fmt.Sprintf("%s:%d:%d:%s:%s", t.Peer, t.IssuedAt.Unix(), t.ExpiresAt.Unix(), t.Nonce, t.ID)
+	keyID, signature := keyring.sign([]byte(tokenVersion + "." + data))
+	return tokenVersion + "." + keyID + "." + base64.URLEncoding.EncodeToString(signature) + "." + base64.URLEncoding.EncodeToString([]byte(data))
 }
 
-func ParsePeer(id string, pid string) (Peer, error) {
-	pidParts := strings.SplitN(pid, ".", 2)
-	if len(pidParts) < 2 {
-		return "", ErrInvalidPeer
+// ParsePeer verifies a peer id issued for connection id and returns its token.
+func ParsePeer(id string, pid string) (PeerToken, error) {
+	pidParts := strings.SplitN(pid, ".", 4)
+	if len(pidParts) < 4 || pidParts[0] != tokenVersion {
+		return PeerToken{}, ErrInvalidPeer
 	}
-	base64Signature, base64Data := pidParts[0], pidParts[1]
+	keyID, base64Signature, base64Data := pidParts[1], pidParts[2], pidParts[3]
 	signatureBytes, err := base64.URLEncoding.DecodeString(base64Signature)
 	if err != nil {
-		return "", ErrInvalidPeer
+		return PeerToken{}, ErrInvalidPeer
 	}
 	dataBytes, err := base64.URLEncoding.DecodeString(base64Data)
 	if err != nil {
-		return "", ErrInvalidPeer
+		return PeerToken{}, ErrInvalidPeer
 	}
 
-	// verify signature
-	hash := hmac.New(sha256.New, secret)
-	hash.Write(dataBytes)
-	verifySignature := hash.Sum(nil)
-	if !hmac.Equal(signatureBytes, verifySignature) {
-		return "", ErrInvalidPeer
+	// verify signature with any active key
+	if !keyring.verify(keyID, []byte(tokenVersion+"."+string(dataBytes)), signatureBytes) {
+		return PeerToken{}, ErrInvalidPeer
 	}
 
-	// verify id is same and peer value is valid
-	data := string(dataBytes)
-	dataParts := strings.SplitN(data, ":", 2)
-	if len(dataParts) < 2 {
-		return "", ErrInvalidPeer
+	// verify id is same and claims are valid
+	dataParts := strings.SplitN(string(dataBytes), ":", 5)
+	if len(dataParts) < 5 {
+		return PeerToken{}, ErrInvalidPeer
+	}
+	issuedAt, err := strconv.ParseInt(dataParts[1], 10, 64)
+	if err != nil {
+		return PeerToken{}, ErrInvalidPeer
+	}
+	expiresAt, err := strconv.ParseInt(dataParts[2], 10, 64)
+	if err != nil {
+		return PeerToken{}, ErrInvalidPeer
+	}
+	token := PeerToken{
+		ID:        dataParts[4],
+		Peer:      Peer(dataParts[0]),
+		IssuedAt:  time.Unix(issuedAt, 0),
+		ExpiresAt: time.Unix(expiresAt, 0),
+		Nonce:     dataParts[3],
+	}
+	if token.ID != id || (token.Peer != PeerSender && token.Peer != PeerReceiver) || token.Nonce == "" {
+		return PeerToken{}, ErrInvalidPeer
+	}
+	now := time.Now()
+	if token.IssuedAt.After(now.Add(maxClockSkew)) || !token.ExpiresAt.After(token.IssuedAt) {
+		return PeerToken{}, ErrInvalidPeer
 	}
-	dataId, dataPeer := dataParts[0], Peer(dataParts[1])
-	if dataId != id || (dataPeer != PeerSender && dataPeer != PeerReceiver) {
-		return "", ErrInvalidPeer
+	if !now.Before(token.ExpiresAt) {
+		return PeerToken{}, ErrExpiredPeer
 	}
-	return dataPeer, nil
+	return token, nil
 }
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeer(t *testing.T) {
+	token, err := NewPeerToken("abc", PeerReceiver, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParsePeer("abc", token.Pid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "abc" || got.Peer != PeerReceiver || got.Nonce != token.Nonce || !got.ExpiresAt.Equal(token.ExpiresAt.Truncate(time.Second)) {
+		t.Errorf("got %+v, want %+v", got, token)
+	}
+
+	now := time.Now()
+	expired := token
+	expired.IssuedAt, expired.ExpiresAt = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	skewed := token
+	skewed.IssuedAt, skewed.ExpiresAt = now.Add(maxClockSkew+time.Minute), now.Add(2*time.Hour)
+	withinSkew := token
+	withinSkew.IssuedAt = now.Add(maxClockSkew / 2)
+	inverted := token
+	inverted.IssuedAt, inverted.ExpiresAt = now, now.Add(-time.Second)
+	invalidPeer := token
+	invalidPeer.Peer = "admin"
+
+	tests := []struct {
+		name string
+		id   string
+		pid  string
+		want error
+	}{
+		{"expired", "abc", expired.Pid(), ErrExpiredPeer},
+		{"issued in the future", "abc", skewed.Pid(), ErrInvalidPeer},
+		{"issued within clock skew", "abc", withinSkew.Pid(), nil},
+		{"expires before issued", "abc", inverted.Pid(), ErrInvalidPeer},
+		{"other connection", "xyz", token.Pid(), ErrInvalidPeer},
+		{"invalid peer", "abc", invalidPeer.Pid(), ErrInvalidPeer},
+		{"empty", "abc", "", ErrInvalidPeer},
+		{"other version", "abc", "v0" + strings.TrimPrefix(token.Pid(), tokenVersion), ErrInvalidPeer},
+		{"tampered data", "abc", tamper(token.Pid()), ErrInvalidPeer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePeer(tt.id, tt.pid); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// tamper replaces the peer in the data of pid without signing it again.
+func tamper(pid string) string {
+	parts := strings.SplitN(pid, ".", 4)
+	data, _ := base64.URLEncoding.DecodeString(parts[3])
+	data = bytes.Replace(data, []byte(PeerReceiver), []byte(PeerSender), 1)
+	parts[3] = base64.URLEncoding.EncodeToString(data)
+	return strings.Join(parts, ".")
+}
+
+func TestRevokeReceiver(t *testing.T) {
+	p := newTestPortal(t)
+	kicked, _ := p.IssueToken("abc", PeerReceiver, time.Hour)
+	other, _ := p.IssueToken("abc", PeerReceiver, time.Hour)
+	if !p.RevokeReceiver("abc", kicked.Nonce) {
+		t.Fatal("token was not found")
+	}
+	if _, err := p.Authenticate("abc", kicked.Pid()); !errors.Is(err, ErrRevokedPeer) {
+		t.Errorf("kicked receiver: got %v, want ErrRevokedPeer", err)
+	}
+	if _, err := p.Authenticate("abc", other.Pid()); err != nil {
+		t.Errorf("other receiver: got %v, want nil", err)
+	}
+}
+
+func TestReceiverTokenCap(t *testing.T) {
+	p := newTestPortal(t)
+	for range maxReceiverTokens {
+		if _, err := p.IssueToken("abc", PeerReceiver, -time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expired tokens make room for new ones
+	for range maxReceiverTokens {
+		if _, err := p.IssueToken("abc", PeerReceiver, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.IssueToken("abc", PeerReceiver, time.Hour); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("got %v, want ErrTooManyTokens", err)
+	}
+	if _, err := p.IssueToken("xyz", PeerReceiver, time.Hour); err != nil {
+		t.Errorf("other connection: got %v, want nil", err)
+	}
+}
+
+func newTestPortal(t *testing.T) *Portal {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := NewIDGenerator("", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPortal(store, time.Hour, ids, Timeouts{})
+}
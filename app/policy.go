@@ -0,0 +1,129 @@
+package app
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Policy restricts the files senders can upload.
+type Policy struct {
+	// MaxFileSize is the maximum size of a file in bytes, zero is unlimited.
+	MaxFileSize int64
+	// Allow and Deny are MIME types like "application/pdf" or "image/*" and file extensions like ".exe".
+	// Denied files are rejected and when Allow is not empty only matching files are accepted.
+	// End-to-end encrypted files can not be inspected so only their extension is matched,
+	// an Allow list of only MIME types rejects them.
+	Allow []string
+	Deny  []string
+}
+
+// ParsePolicyList parses a comma separated list of MIME types and extensions.
+func ParsePolicyList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Check returns a ClientError explaining why the file named name is rejected.
+// An empty contentType is unknown and only matches extensions.
+func (p Policy) Check(name, contentType string, size int64) error {
+	if p.MaxFileSize > 0 && size > p.MaxFileSize {
+		return fileTooLargeError(name, p.MaxFileSize)
+	}
+	mediaType := ""
+	if contentType != "" {
+		mediaType, _, _ = mime.ParseMediaType(contentType)
+	}
+	describe := name
+	if mediaType != "" {
+		describe = fmt.Sprintf("%s (%s)", name, mediaType)
+	}
+	if matchPolicy(p.Deny, name, mediaType) {
+		return NewClientError(nil, "File type not allowed").
+			WithDesc(fmt.Sprintf("%s is a type of file that can not be sent.", describe)).
+			WithStatus(http.StatusUnsupportedMediaType)
+	}
+	if len(p.Allow) > 0 && !matchPolicy(p.Allow, name, mediaType) {
+		return NewClientError(nil, "File type not allowed").
+			WithDesc(fmt.Sprintf("%s can not be sent, only %s files are allowed.", describe, strings.Join(p.Allow, ", "))).
+			WithStatus(http.StatusUnsupportedMediaType)
+	}
+	return nil
+}
+
+func fileTooLargeError(name string, max int64) ClientError {
+	return NewClientError(nil, "File too large").
+		WithDesc(fmt.Sprintf("%s is larger than the maximum file size of %s.", name, humanSize(max))).
+		WithStatus(http.StatusRequestEntityTooLarge)
+}
+
+func matchPolicy(list []string, name, mediaType string) bool {
+	name = strings.ToLower(name)
+	for _, entry := range list {
+		switch {
+		case strings.HasPrefix(entry, "."):
+			// suffixes match compound extensions like .tar.gz
+			if strings.HasSuffix(name, entry) {
+				return true
+			}
+		case mediaType == "":
+		case strings.HasSuffix(entry, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+		case entry == mediaType:
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSize parses a size in bytes like "10MB" or "512KiB", units are binary so 1KB is 1024 bytes.
+// An empty size is zero.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit := strings.ToUpper(strings.TrimSpace(s[i:]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	exp := strings.Index("KMGT", unit)
+	if unit == "" {
+		exp = -1
+	} else if len(unit) != 1 || exp < 0 {
+		return 0, fmt.Errorf("invalid size unit %q", s[i:])
+	}
+	for ; exp >= 0; exp-- {
+		n *= 1024
+	}
+	return int64(n), nil
+}
+
+// humanSize formats a size in bytes with binary units.
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,33 @@
+package app
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512, false},
+		{"10B", 10, false},
+		{"1KB", 1024, false},
+		{"1KiB", 1024, false},
+		{"1.5k", 1536, false},
+		{" 10 MB ", 10 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1TB", 1 << 40, false},
+		{"-1MB", 0, true},
+		{"MB", 0, true},
+		{"1PB", 0, true},
+		{"1MBs", 0, true},
+		{"1..5MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
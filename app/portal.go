@@ -1,21 +1,61 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 )
 
+var ErrRevokedPeer = errors.New("revoked peer id")
+
+// ErrTooManyTokens means a connection already has as many unexpired receiver tokens as allowed.
+var ErrTooManyTokens = errors.New("too many receiver tokens")
+
+// maxReceiverTokens caps the receiver tokens tracked per connection, since anyone with the link can ask for one.
+const maxReceiverTokens = 100
+
 type Portal struct {
-	conns map[string]*Conn
-	mu    sync.RWMutex
+	conns    map[string]*Conn
+	mu       sync.RWMutex
+	store    BlobStore
+	ttl      time.Duration
+	ids      IDGenerator
+	timeouts Timeouts
+
+	// receiver tokens issued per connection and revoked token nonces until they expire
+	tokens   map[string][]PeerToken
+	revoked  map[string]time.Time
+	tokensMu sync.Mutex
 }
 
-func NewPortal() *Portal {
-	return &Portal{
-		conns: make(map[string]*Conn),
+// NewPortal creates a new portal with connection IDs generated by ids.
+// Files of connections in store mode are kept in store for at most ttl.
+// Connections are disposed in the background once they end or exceed timeouts.
+func NewPortal(store BlobStore, ttl time.Duration, ids IDGenerator, timeouts Timeouts) *Portal {
+	p := &Portal{
+		conns:    make(map[string]*Conn),
+		store:    store,
+		ttl:      ttl,
+		ids:      ids,
+		timeouts: timeouts.withDefaults(),
+		tokens:   make(map[string][]PeerToken),
+		revoked:  make(map[string]time.Time),
 	}
+	go p.janitor()
+	return p
+}
+
+// IDs returns the generator of connection IDs.
+func (p *Portal) IDs() IDGenerator { return p.ids }
+
+// MaxExpiry returns the longest expiry of a connection.
+func (p *Portal) MaxExpiry() time.Duration { return p.timeouts.Lifetime }
+
+// StoredFor returns how long the files of a connection in store mode are still kept.
+func (p *Portal) StoredFor(conn *Conn) time.Duration {
+	return min(p.ttl, time.Until(conn.ExpiresAt()))
 }
 
 func (p *Portal) GetConnection(id string) (*Conn, error) {
@@ -28,39 +68,121 @@ func (p *Portal) GetConnection(id string) (*Conn, error) {
 	return conn, nil
 }
 
-func (p *Portal) CreateConnection() (string, error) {
-	return p.createConnectionWithRetries(3)
+// State returns the state of connection id.
+func (p *Portal) State(id string) (ConnState, error) {
+	conn, err := p.GetConnection(id)
+	if err != nil {
+		return "", err
+	}
+	return conn.State(), nil
 }
 
-func (p *Portal) createConnectionWithRetries(n int) (string, error) {
+// CreateConnection creates a connection, an Expiry that is not set or longer than MaxExpiry is MaxExpiry.
+func (p *Portal) CreateConnection(opts ConnOptions) (string, error) {
+	if opts.Expiry <= 0 || opts.Expiry > p.timeouts.Lifetime {
+		opts.Expiry = p.timeouts.Lifetime
+	}
+	return p.createConnectionWithRetries(opts, 3)
+}
+
+func (p *Portal) createConnectionWithRetries(opts ConnOptions, n int) (string, error) {
 	if n <= 0 {
 		return "", fmt.Errorf("failed to create connection")
 	}
-	id := generateId()
+	if opts.Mode == ModeStore && p.store == nil {
+		return "", fmt.Errorf("store mode is not available")
+	}
+	id, err := p.ids.Generate()
+	if err != nil {
+		return "", err
+	}
 	p.mu.Lock()
 	if _, ok := p.conns[id]; ok {
 		p.mu.Unlock()
-		return p.createConnectionWithRetries(n - 1)
+		return p.createConnectionWithRetries(opts, n-1)
 	}
 	defer p.mu.Unlock()
-	conn := NewConn()
-	p.conns[id] = conn
-	go p.disposeIdleConnection(id, conn)
+	p.conns[id] = NewConn(id, opts, p.store)
 	return id, nil
 }
 
-func (p *Portal) disposeIdleConnection(id string, conn *Conn) {
-	timer := time.NewTimer(time.Minute * 5)
-	defer timer.Stop()
-	select {
-	case <-conn.AnyJoined():
-		return
-	case <-timer.C:
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		conn.Close()
-		delete(p.conns, id)
-		log.Println("disposed idle connection", id)
+// DisposeConnection closes and removes a connection, reason is reported to its peers.
+func (p *Portal) DisposeConnection(id string, reason DisposeReason) {
+	p.mu.Lock()
+	conn, ok := p.conns[id]
+	delete(p.conns, id)
+	p.mu.Unlock()
+	if !ok {
 		return
 	}
+	p.forgetTokens(id)
+	conn.Broadcast(Mssg{Data: reason.Message()})
+	conn.Close()
+	log.Printf("disposed connection %s: %s", id, reason)
+}
+
+// IssueToken issues a token for peer in connection id valid for ttl.
+// Receiver tokens are tracked until they expire so they can be revoked by the sender.
+func (p *Portal) IssueToken(id string, peer Peer, ttl time.Duration) (PeerToken, error) {
+	token, err := NewPeerToken(id, peer, ttl)
+	if err != nil || peer != PeerReceiver {
+		return token, err
+	}
+	p.tokensMu.Lock()
+	defer p.tokensMu.Unlock()
+	// expired tokens are rejected anyway so they no longer need to be tracked
+	tokens := p.tokens[id][:0]
+	for _, t := range p.tokens[id] {
+		if token.IssuedAt.Before(t.ExpiresAt) {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) >= maxReceiverTokens {
+		p.tokens[id] = tokens
+		return PeerToken{}, ErrTooManyTokens
+	}
+	p.tokens[id] = append(tokens, token)
+	return token, nil
+}
+
+// Authenticate verifies a peer id of connection id and rejects revoked tokens.
+func (p *Portal) Authenticate(id string, pid string) (PeerToken, error) {
+	token, err := ParsePeer(id, pid)
+	if err != nil {
+		return PeerToken{}, err
+	}
+	p.tokensMu.Lock()
+	defer p.tokensMu.Unlock()
+	if _, ok := p.revoked[token.Nonce]; ok {
+		return PeerToken{}, ErrRevokedPeer
+	}
+	return token, nil
+}
+
+// RevokeReceiver revokes the receiver token of connection id with nonce and reports whether it was found.
+func (p *Portal) RevokeReceiver(id string, nonce string) bool {
+	p.tokensMu.Lock()
+	defer p.tokensMu.Unlock()
+	// expired tokens are rejected anyway so they no longer need to be listed
+	now := time.Now()
+	for nonce, expiresAt := range p.revoked {
+		if !now.Before(expiresAt) {
+			delete(p.revoked, nonce)
+		}
+	}
+	tokens := p.tokens[id]
+	for i, token := range tokens {
+		if token.Nonce == nonce {
+			p.revoked[nonce] = token.ExpiresAt
+			p.tokens[id] = append(tokens[:i], tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Portal) forgetTokens(id string) {
+	p.tokensMu.Lock()
+	defer p.tokensMu.Unlock()
+	delete(p.tokens, id)
 }
@@ -1,32 +1,108 @@
 package app
 
 import (
+	"crypto/hmac"
 	crypto "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
+	"regexp"
+	"strings"
 )
 
-var secret []byte
+const minSecretLen = 32
 
-func init() {
-	secret = make([]byte, 32)
-	if _, err := crypto.Read(secret); err != nil {
-		log.Fatal("error generating application secret:", err)
+var ErrInvalidKeyring = errors.New("invalid keyring")
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Key is a secret used to sign peer ids, its ID is embedded in signed ids to select the key when verifying.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring holds the active signing keys.
+// The first key is the newest and signs new peer ids, all keys are accepted when verifying.
+type Keyring struct {
+	keys []Key
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKeyring)
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !keyIDPattern.MatchString(key.ID) || seen[key.ID] {
+			return nil, fmt.Errorf("%w: invalid or duplicate key id %q", ErrInvalidKeyring, key.ID)
+		}
+		if len(key.Secret) < minSecretLen {
+			return nil, fmt.Errorf("%w: key %q must be at least %d bytes", ErrInvalidKeyring, key.ID, minSecretLen)
+		}
+		seen[key.ID] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeyring parses keys separated by commas or newlines, newest first.
+// Each key is formatted as id:secret where secret is base64 encoded.
+func ParseKeyring(s string) (*Keyring, error) {
+	var keys []Key
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: key must be formatted as id:secret", ErrInvalidKeyring)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q is not valid base64", ErrInvalidKeyring, id)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
 	}
+	return NewKeyring(keys...)
 }
 
-const letters, numbers = "abcdefghijklmnopqrstuvwxyz", "1234567890"
-const idCharsLen, idNumsLen = 4, 3
-const idLen = idCharsLen + idNumsLen
+// sign signs data with the newest key.
+func (k *Keyring) sign(data []byte) (string, []byte) {
+	key := k.keys[0]
+	return key.ID, signature(key.Secret, data)
+}
 
-func generateId() string {
-	l := make([]byte, idCharsLen)
-	for i := range l {
-		l[i] = letters[rand.Intn(len(letters))]
+// verify checks the signature of data with the key of id.
+func (k *Keyring) verify(id string, data, sig []byte) bool {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return hmac.Equal(sig, signature(key.Secret, data))
+		}
 	}
-	n := make([]byte, idNumsLen)
-	for i := range n {
-		n[i] = numbers[rand.Intn(len(numbers))]
+	return false
+}
+
+func signature(secret, data []byte) []byte {
+	hash := hmac.New(sha256.New, secret)
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+// keyring defaults to a random key so peer ids are only valid until restart unless a keyring is configured.
+var keyring *Keyring
+
+// SetKeyring replaces the keyring used to sign and verify peer ids, it must be called before serving requests.
+func SetKeyring(k *Keyring) {
+	keyring = k
+}
+
+func init() {
+	secret := make([]byte, minSecretLen)
+	if _, err := crypto.Read(secret); err != nil {
+		log.Fatal("error generating application secret:", err)
 	}
-	return string(l) + string(n)
+	keyring = &Keyring{keys: []Key{{ID: "ephemeral", Secret: secret}}}
 }
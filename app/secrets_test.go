@@ -0,0 +1,85 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseKeyring(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minSecretLen))
+	short := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minSecretLen-1))
+	tests := []struct {
+		in   string
+		keys []string
+	}{
+		{"new:" + secret + ",old:" + secret, []string{"new", "old"}},
+		{"# rotated on monday\nnew:" + secret + "\n\nold:" + secret + "\n", []string{"new", "old"}},
+		{"", nil},
+		{"new", nil},
+		{"new:not base64", nil},
+		{"new:" + short, nil},
+		{"new key:" + secret, nil},
+		{"new:" + secret + ",new:" + secret, nil},
+	}
+	for _, tt := range tests {
+		k, err := ParseKeyring(tt.in)
+		if tt.keys == nil {
+			if !errors.Is(err, ErrInvalidKeyring) {
+				t.Errorf("ParseKeyring(%q): got %v, want ErrInvalidKeyring", tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseKeyring(%q): %v", tt.in, err)
+			continue
+		}
+		var ids []string
+		for _, key := range k.keys {
+			ids = append(ids, key.ID)
+		}
+		if !slices.Equal(ids, tt.keys) {
+			t.Errorf("ParseKeyring(%q): keys %v, want %v", tt.in, ids, tt.keys)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer SetKeyring(keyring)
+	oldKey := Key{ID: "old", Secret: bytes.Repeat([]byte{1}, minSecretLen)}
+	newKey := Key{ID: "new", Secret: bytes.Repeat([]byte{2}, minSecretLen)}
+	setKeyring(t, oldKey)
+
+	token, err := NewPeerToken("abc", PeerSender, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := token.Pid()
+
+	// ids signed with an older key are accepted while it is in the keyring
+	setKeyring(t, newKey, oldKey)
+	if _, err := ParsePeer("abc", pid); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	setKeyring(t, newKey)
+	if _, err := ParsePeer("abc", pid); !errors.Is(err, ErrInvalidPeer) {
+		t.Errorf("removed key: got %v, want ErrInvalidPeer", err)
+	}
+	// a key with the same id but another secret is a wrong key
+	setKeyring(t, Key{ID: "old", Secret: newKey.Secret})
+	if _, err := ParsePeer("abc", pid); !errors.Is(err, ErrInvalidPeer) {
+		t.Errorf("wrong key: got %v, want ErrInvalidPeer", err)
+	}
+}
+
+func setKeyring(t *testing.T, keys ...Key) {
+	t.Helper()
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(k)
+}
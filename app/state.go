@@ -0,0 +1,81 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var ErrConnEnded = errors.New("connection has ended")
+
+// ConnState is the stage of a connection in its lifecycle.
+type ConnState string
+
+const (
+	// StateCreated is a connection nobody has joined yet.
+	StateCreated ConnState = "created"
+	// StateSenderJoined is a connection the sender has joined, waiting for a receiver.
+	StateSenderJoined ConnState = "sender-joined"
+	// StateReceiverJoined is a connection a receiver has joined, the sender may not have joined yet.
+	StateReceiverJoined ConnState = "receiver-joined"
+	// StateTransferring is a connection the sender has started uploading files to.
+	StateTransferring ConnState = "transferring"
+	// StateCompleted is a connection whose files have all been received.
+	StateCompleted ConnState = "completed"
+	// StateFailed is a connection whose transfer failed.
+	StateFailed ConnState = "failed"
+	// StateExpired is a connection that was closed before its transfer ended.
+	StateExpired ConnState = "expired"
+)
+
+// transitions lists the states each state can move to, final states can not move.
+var transitions = map[ConnState][]ConnState{
+	StateCreated:        {StateSenderJoined, StateReceiverJoined, StateFailed, StateExpired},
+	StateSenderJoined:   {StateReceiverJoined, StateTransferring, StateFailed, StateExpired},
+	StateReceiverJoined: {StateTransferring, StateFailed, StateExpired},
+	StateTransferring:   {StateCompleted, StateFailed, StateExpired},
+}
+
+// Final reports whether the connection can no longer change state.
+func (s ConnState) Final() bool {
+	_, ok := transitions[s]
+	return !ok
+}
+
+// CanTransition reports whether a connection in state s can move to state to.
+func (s ConnState) CanTransition(to ConnState) bool {
+	return slices.Contains(transitions[s], to)
+}
+
+// transitionLocked moves the connection to state to, c.stateMu must be held.
+func (c *Conn) transitionLocked(to ConnState) error {
+	if !c.state.CanTransition(to) {
+		return fmt.Errorf("invalid connection state transition from %s to %s", c.state, to)
+	}
+	c.state = to
+	c.changed = time.Now()
+	c.touch()
+	return nil
+}
+
+// transition moves the connection to state to, it fails if to can not follow the current state.
+func (c *Conn) transition(to ConnState) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.transitionLocked(to)
+}
+
+// State returns the current state of the connection.
+func (c *Conn) State() ConnState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// StateSince returns the current state of the connection and when it was entered.
+func (c *Conn) StateSince() (ConnState, time.Time) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state, c.changed
+}
@@ -0,0 +1,48 @@
+package app
+
+import "testing"
+
+func TestConnStateTransitions(t *testing.T) {
+	states := []ConnState{StateCreated, StateSenderJoined, StateReceiverJoined, StateTransferring, StateCompleted, StateFailed, StateExpired}
+	allowed := map[[2]ConnState]bool{
+		{StateCreated, StateSenderJoined}:        true,
+		{StateCreated, StateReceiverJoined}:      true,
+		{StateSenderJoined, StateReceiverJoined}: true,
+		{StateSenderJoined, StateTransferring}:   true,
+		{StateReceiverJoined, StateTransferring}: true,
+		{StateTransferring, StateCompleted}:      true,
+	}
+	for _, from := range states {
+		for _, to := range states {
+			// any connection that has not ended can fail or expire
+			want := allowed[[2]ConnState{from, to}] || (!from.Final() && (to == StateFailed || to == StateExpired))
+			if got := from.CanTransition(to); got != want {
+				t.Errorf("%s -> %s: got %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	for _, s := range states {
+		want := s == StateCompleted || s == StateFailed || s == StateExpired
+		if s.Final() != want {
+			t.Errorf("%s: Final is %v, want %v", s, s.Final(), want)
+		}
+	}
+}
+
+func TestConnTransition(t *testing.T) {
+	c := NewConn("abc", ConnOptions{Mode: ModeDirect}, nil)
+	if err := c.transition(StateTransferring); err == nil {
+		t.Error("created connection started transferring before anybody joined")
+	}
+	for _, to := range []ConnState{StateSenderJoined, StateReceiverJoined, StateTransferring, StateCompleted} {
+		if err := c.transition(to); err != nil {
+			t.Fatalf("transition to %s: %v", to, err)
+		}
+	}
+	if err := c.transition(StateFailed); err == nil {
+		t.Error("completed connection failed")
+	}
+	if s := c.State(); s != StateCompleted {
+		t.Errorf("state is %s, want %s", s, StateCompleted)
+	}
+}
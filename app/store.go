@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore stores uploaded files so receivers can download them after the sender leaves.
+type BlobStore interface {
+	Create(key string) (io.WriteCloser, error)
+	Open(key string) (Blob, error)
+	Delete(key string) error
+}
+
+type Blob interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// FSStore is a BlobStore that keeps blobs as files in a directory on the local filesystem.
+type FSStore struct {
+	dir string
+}
+
+func NewFSStore(dir string) (*FSStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FSStore{dir: dir}, nil
+}
+
+func (s *FSStore) Create(key string) (io.WriteCloser, error) {
+	return os.OpenFile(s.path(key), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func (s *FSStore) Open(key string) (Blob, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *FSStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Clear deletes every blob in the store and returns how many were deleted.
+// Connections do not survive a restart, so blobs left behind by a previous run are never deleted otherwise.
+func (s *FSStore) Clear() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *FSStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+// rangeTracker records the offset of the content where serving started.
+// Reads fail once ctx is done so a download stops as soon as the receiver is removed.
+type rangeTracker struct {
+	io.ReadSeeker
+	ctx     context.Context
+	pos     int64
+	start   int64
+	started bool
+}
+
+func (rt *rangeTracker) Read(p []byte) (int, error) {
+	if err := context.Cause(rt.ctx); err != nil {
+		return 0, err
+	}
+	if !rt.started {
+		rt.start, rt.started = rt.pos, true
+	}
+	n, err := rt.ReadSeeker.Read(p)
+	rt.pos += int64(n)
+	return n, err
+}
+
+func (rt *rangeTracker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := rt.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		rt.pos = pos
+	}
+	return pos, err
+}
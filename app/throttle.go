@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleOptions are limits in bytes per second, zero is unlimited.
+type ThrottleOptions struct {
+	Connection int64
+	IP         int64
+	Global     int64
+}
+
+// Throttle limits the rate of transfers with token buckets per connection, per client IP and globally.
+// Bytes are limited once as they enter the relay: uploads are limited while receivers of a stream
+// read at the rate of the upload, and only downloads of stored files are limited on the way out.
+type Throttle struct {
+	opts    ThrottleOptions
+	global  *bucket
+	mu      sync.Mutex
+	buckets map[string]*sharedBucket
+}
+
+type sharedBucket struct {
+	*bucket
+	refs int
+}
+
+func NewThrottle(opts ThrottleOptions) *Throttle {
+	t := &Throttle{opts: opts, buckets: make(map[string]*sharedBucket)}
+	if opts.Global > 0 {
+		t.global = newBucket(opts.Global)
+	}
+	return t
+}
+
+// Reader limits reads from r of a transfer on connection id by a client at ip, release must be called once done.
+func (t *Throttle) Reader(ctx context.Context, r io.Reader, id, ip string) (reader io.Reader, release func()) {
+	buckets, release := t.acquire(id, ip)
+	if len(buckets) == 0 {
+		return r, release
+	}
+	return &throttledReader{ctx: ctx, r: r, buckets: buckets}, release
+}
+
+// ResponseWriter limits writes to w like Reader.
+func (t *Throttle) ResponseWriter(ctx context.Context, w http.ResponseWriter, id, ip string) (writer http.ResponseWriter, release func()) {
+	buckets, release := t.acquire(id, ip)
+	if len(buckets) == 0 {
+		return w, release
+	}
+	return &throttledResponseWriter{ResponseWriter: w, ctx: ctx, buckets: buckets}, release
+}
+
+// acquire returns the buckets of a transfer, buckets are shared by concurrent transfers and removed once released.
+func (t *Throttle) acquire(id, ip string) ([]*bucket, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buckets []*bucket
+	var keys []string
+	for _, limit := range []struct {
+		key  string
+		rate int64
+	}{{"conn:" + id, t.opts.Connection}, {"ip:" + ip, t.opts.IP}} {
+		if limit.rate <= 0 {
+			continue
+		}
+		sb, ok := t.buckets[limit.key]
+		if !ok {
+			sb = &sharedBucket{bucket: newBucket(limit.rate)}
+			t.buckets[limit.key] = sb
+		}
+		sb.refs++
+		buckets = append(buckets, sb.bucket)
+		keys = append(keys, limit.key)
+	}
+	if t.global != nil {
+		buckets = append(buckets, t.global)
+	}
+	var once sync.Once
+	return buckets, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			for _, key := range keys {
+				if sb := t.buckets[key]; sb != nil {
+					if sb.refs--; sb.refs == 0 {
+						delete(t.buckets, key)
+					}
+				}
+			}
+		})
+	}
+}
+
+// bucket is a token bucket holding up to one second of tokens.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens and waits until the bucket is no longer in debt.
+// Tokens are taken up front so concurrent transfers queue up instead of racing for refills.
+func (b *bucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleChunk bounds the bytes taken at once so slow limits are still spread over time.
+const throttleChunk = 16 * 1024
+
+func waitAll(ctx context.Context, buckets []*bucket, n int) error {
+	for _, b := range buckets {
+		if err := b.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*bucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := waitAll(tr.ctx, tr.buckets, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*bucket
+}
+
+func (tw *throttledResponseWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if err := waitAll(tw.ctx, tw.buckets, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledResponseWriter) Unwrap() http.ResponseWriter { return tw.ResponseWriter }
+
+// ParseRate parses a rate in bytes per second like "10MB" or "512KiB/s", see ParseSize.
+// An empty rate is unlimited.
+func ParseRate(s string) (int64, error) {
+	return ParseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+}
+
+// humanRate formats a rate in bytes per second with binary units.
+func humanRate(rate int64) string { return humanSize(rate) + "/s" }
+
+// clientIP returns the IP address of the client, from the last X-Forwarded-For entry when behind a trusted proxy.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
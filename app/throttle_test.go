@@ -0,0 +1,23 @@
+package app
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"", 0, false},
+		{"1MB", 1 << 20, false},
+		{"512KiB/s", 512 << 10, false},
+		{" 2MB/s ", 2 << 20, false},
+		{"1MB/m", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
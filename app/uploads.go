@@ -0,0 +1,307 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/eriicafes/httportal/e2e"
+)
+
+// Chunked uploads follow the tus 1.0.0 core protocol (https://tus.io/protocols/resumable-upload),
+// with the creation step replaced by a manifest of all files since a connection carries many files.
+//
+//	POST  /transfer/{id}/uploads          declare files with a JSON encoded Headers body, repeating the same body is a no-op
+//	HEAD  /transfer/{id}/uploads/{index}  get the Upload-Offset and Upload-Length of a file
+//	PATCH /transfer/{id}/uploads/{index}  append an application/offset+octet-stream body at Upload-Offset
+//
+// Files are uploaded in order. A PATCH with an Upload-Offset different from the current offset
+// is rejected with 409 Conflict and the current Upload-Offset, so the client can resume from it.
+// A PATCH sent before a direct transfer has a receiver is rejected with 503 Service Unavailable
+// and Retry-After once maxReceiverWait passes, so the client retries the chunk.
+const tusVersion = "1.0.0"
+
+// maxReceiverWait bounds how long a chunk waits for a receiver, it is at most half the transfer timeout.
+const maxReceiverWait = 30 * time.Second
+
+func (app *App) uploadCreate(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	conn, token, err := app.senderConn(r)
+	if err != nil {
+		return err
+	}
+	var headers Headers
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&headers); err != nil {
+		return NewClientError(err, "Upload failed").WithDesc("Failed to parse uploaded files.")
+	}
+	if err = app.validateHeaders(&headers); err != nil {
+		return err
+	}
+	if headers.Size() == UnknownSize {
+		return NewClientError(nil, "Upload failed").WithDesc("Chunked uploads require the size of every file.")
+	}
+
+	// repeated requests after a dropped response get the same result
+	if existing, ok := conn.Headers(); ok {
+		if existing.Encrypted != headers.Encrypted || !slices.Equal(existing.Files, headers.Files) {
+			return NewClientError(nil, "Upload failed").
+				WithDesc("Files have already been uploaded to this connection.").
+				WithStatus(http.StatusConflict)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(existing)
+	}
+	// enter connection
+	if err = conn.Enter(PeerSender, token.Nonce); err != nil {
+		return enterError(PeerSender, err)
+	}
+	conn.Broadcast(Mssg{Data: "Sender has joined connection"})
+	if manifest, err := json.Marshal(headers); err == nil {
+		conn.Broadcast(Mssg{Event: "manifest", Data: string(manifest)})
+	}
+	conn.Broadcast(Mssg{Data: "Waiting to upload"})
+
+	// headers are sent in the background since sending waits for a receiver,
+	// chunked uploads outlive their requests so only the end of the connection stops the wait
+	go conn.SendHeaders(context.Background(), headers)
+
+	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(headers)
+}
+
+// validateHeaders sanitizes the declared files of an upload and checks them against the policy.
+func (app *App) validateHeaders(headers *Headers) error {
+	if len(headers.Files) == 0 {
+		return NewClientError(nil, "Upload failed").WithDesc("Select at least one file to upload.")
+	}
+	for i, file := range headers.Files {
+		file.Filename = sanitizeFilename(file.Filename)
+		if file.Path = sanitizePath(file.Path); file.Path == "" {
+			file.Path = file.Filename
+		}
+		if file.Path == "" || (file.Size < 0 && file.Size != UnknownSize) {
+			return NewClientError(nil, "Upload failed").WithDesc("Invalid file name or size.")
+		}
+		// receivers tell streamed files apart by their size so only the last can be read until the end
+		if file.Size == UnknownSize && i != len(headers.Files)-1 {
+			return NewClientError(nil, "Upload failed").WithDesc("Only the last file can have an unknown size.")
+		}
+		if headers.Encrypted && file.Size != UnknownSize && file.Size < e2e.Overhead {
+			return NewClientError(nil, "Upload failed").WithDesc("Invalid encrypted file size.")
+		}
+		if _, _, err := mime.ParseMediaType(file.ContentType); err != nil {
+			file.ContentType = "application/octet-stream"
+		}
+		var err error
+		if file.SHA256, err = parseChecksum(file.SHA256); err != nil {
+			return err
+		}
+		// declared types are checked now and the content once it is uploaded
+		checkedType := file.ContentType
+		if headers.Encrypted {
+			checkedType = ""
+		}
+		if err := app.config.Policy.Check(file.Path, checkedType, file.Size); err != nil {
+			return err
+		}
+		headers.Files[i] = file
+	}
+	return nil
+}
+
+func (app *App) uploadOffset(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	conn, _, err := app.senderConn(r)
+	if err != nil {
+		return err
+	}
+	file, index, err := uploadFile(r, conn)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprint(conn.Offset(index)))
+	w.Header().Set("Upload-Length", fmt.Sprint(file.Size))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (app *App) uploadChunk(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	conn, _, err := app.senderConn(r)
+	if err != nil {
+		return err
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return NewClientError(nil, "Upload failed").
+			WithDesc("Chunks must be sent as application/offset+octet-stream.").
+			WithStatus(http.StatusUnsupportedMediaType)
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return NewClientError(err, "Upload failed").WithDesc("Invalid upload offset.")
+	}
+	file, index, err := uploadFile(r, conn)
+	if err != nil {
+		return err
+	}
+	headers, _ := conn.Headers()
+	if offset != conn.Offset(index) {
+		return offsetError(w, conn, index)
+	}
+	// direct transfers start once a receiver joins, the client retries rather than timing out while waiting
+	wait := time.NewTimer(min(maxReceiverWait, app.config.TransferTimeout/2))
+	defer wait.Stop()
+	select {
+	case <-conn.HeadersSent():
+	case <-wait.C:
+		w.Header().Set("Upload-Offset", fmt.Sprint(offset))
+		w.Header().Set("Retry-After", "1")
+		return NewClientError(nil, "Waiting for a receiver").
+			WithDesc("Retry the upload once a receiver has joined.").
+			WithStatus(http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+		return NewClientError(r.Context().Err(), "Upload interrupted").WithDesc("Resume the upload from the current offset.")
+	}
+	if offset == 0 {
+		if index == 0 {
+			conn.Broadcast(Mssg{Data: "Uploading..."})
+		}
+		if len(headers.Files) > 1 {
+			conn.Broadcast(Mssg{Data: fmt.Sprintf("Uploading %s (%d/%d)", file.Path, index+1, len(headers.Files))})
+		}
+	}
+
+	// start goroutine to broadcast upload progress every second
+	go app.broadcastProgress(r.Context(), conn, headers.Size())
+
+	var body io.Reader = r.Body
+	if offset == 0 && !headers.Encrypted {
+		if body, err = app.checkContent(conn, file, body); err != nil {
+			if _, ok := err.(ClientError); ok {
+				return err
+			}
+			conn.Broadcast(Mssg{Data: "Upload interrupted, waiting for sender to resume"})
+			return NewClientError(err, "Upload interrupted").WithDesc("Resume the upload from the current offset.")
+		}
+	}
+	body, release := app.throttle.Reader(r.Context(), body, r.PathValue("id"), clientIP(r, app.config.TrustProxy))
+	defer release()
+	_, err = conn.SendChunk(r.Context(), index, offset, body)
+	if err != nil {
+		if errors.Is(err, ErrOffsetMismatch) {
+			return offsetError(w, conn, index)
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			conn.Broadcast(Mssg{Data: fmt.Sprintf("Upload failed, %s does not match its checksum", file.Path)})
+			conn.CloseWriter()
+			return NewClientError(err, "Upload failed").
+				WithDesc("The uploaded file does not match its checksum.").
+				WithStatus(http.StatusUnprocessableEntity)
+		}
+		if conn.Err() != nil {
+			conn.Broadcast(Mssg{Data: "Upload failed"})
+			conn.CloseWriter()
+			return NewClientError(err, "Upload failed").
+				WithDesc("The transfer has failed.").
+				WithStatus(http.StatusGone)
+		}
+		if errors.Is(err, ErrFileOrder) {
+			return NewClientError(err, "Upload failed").
+				WithDesc("Files must be uploaded in order.").
+				WithStatus(http.StatusConflict)
+		}
+		conn.Broadcast(Mssg{Data: "Upload interrupted, waiting for sender to resume"})
+		return NewClientError(err, "Upload interrupted").WithDesc("Resume the upload from the current offset.")
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprint(conn.Offset(index)))
+	if conn.Sent() {
+		conn.Broadcast(Mssg{Event: "progress", Data: "100%"})
+		conn.Broadcast(Mssg{Data: "Upload complete"})
+		if conn.Mode() == ModeStore {
+			conn.Broadcast(Mssg{Data: fmt.Sprintf("Files are available to download for %s", humanDuration(app.portal.StoredFor(conn)))})
+		}
+		conn.CloseWriter()
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// offsetError rejects a chunk that does not continue from the current offset of the file at index.
+func offsetError(w http.ResponseWriter, conn *Conn, index int) error {
+	w.Header().Set("Upload-Offset", fmt.Sprint(conn.Offset(index)))
+	return NewClientError(ErrOffsetMismatch, "Upload failed").
+		WithDesc("Upload offset does not match, resume from the current offset.").
+		WithStatus(http.StatusConflict)
+}
+
+// checkContent checks the content type sniffed from the start of body against the policy and returns a reader of the whole body.
+// A rejected file fails the connection since its receivers are already waiting for it and is reported as a ClientError,
+// other errors come from reading body.
+func (app *App) checkContent(conn *Conn, file FileHeader, body io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(body, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := app.config.Policy.Check(file.Path, http.DetectContentType(head), file.Size); err != nil {
+		conn.fail(err)
+		conn.Broadcast(Mssg{Data: fmt.Sprintf("Upload failed, %s was rejected", file.Path)})
+		conn.CloseWriter()
+		return nil, err
+	}
+	return br, nil
+}
+
+// senderConn returns the connection and token of a request made by the sender.
+func (app *App) senderConn(r *http.Request) (*Conn, PeerToken, error) {
+	id := r.PathValue("id")
+	// get peer from bearer token or cookie
+	pid, err := sessionPid(r)
+	if err != nil {
+		return nil, PeerToken{}, NewClientError(err, "Unauthorized to send").
+			WithDesc("Create a new connection to send.").
+			WithStatus(http.StatusUnauthorized)
+	}
+	token, err := app.portal.Authenticate(id, pid)
+	if err != nil || token.Peer != PeerSender {
+		return nil, PeerToken{}, NewClientError(err, "Unauthorized to send").
+			WithDesc("Only sender is allowed to send.").
+			WithStatus(http.StatusUnauthorized)
+	}
+	// get connection
+	conn, err := app.portal.GetConnection(id)
+	if err != nil {
+		return nil, token, NewClientError(err, "Connection not found").
+			WithDesc("The connection has expired.").
+			WithStatus(http.StatusNotFound)
+	}
+	return conn, token, nil
+}
+
+// uploadFile returns the declared file and index of a chunked upload request.
+func uploadFile(r *http.Request, conn *Conn) (FileHeader, int, error) {
+	headers, ok := conn.Headers()
+	if !ok {
+		return FileHeader{}, 0, NewClientError(nil, "Upload not found").
+			WithDesc("Declare the files to upload first.").
+			WithStatus(http.StatusNotFound)
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(headers.Files) {
+		return FileHeader{}, 0, NewClientError(err, "Upload not found").
+			WithDesc("Invalid file index.").
+			WithStatus(http.StatusNotFound)
+	}
+	return headers.Files[index], index, nil
+}
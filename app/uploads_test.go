@@ -0,0 +1,118 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the API of a new app and returns its URL.
+func newTestServer(t *testing.T, config Config) string {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := NewIDGenerator("", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	New(nil, NewPortal(store, time.Hour, ids, Timeouts{}), config).Mount(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL + "/api/v1"
+}
+
+func request(t *testing.T, method, url, token, contentType, body string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// createUpload creates a connection in mode and declares files of the given contents.
+func createUpload(t *testing.T, url, mode string, contents ...string) (apiSession, string) {
+	t.Helper()
+	res := request(t, http.MethodPost, url+"/connections", "", "application/json", `{"mode":"`+mode+`"}`, nil)
+	var s apiSession
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	var headers Headers
+	for i, content := range contents {
+		name := fmt.Sprintf("%c.txt", 'a'+i)
+		headers.Files = append(headers.Files, FileHeader{Filename: name, Path: name, Size: int64(len(content)), ContentType: "text/plain"})
+	}
+	manifest, _ := json.Marshal(headers)
+	uploads := url + "/connections/" + s.ID + "/uploads"
+	if res = request(t, http.MethodPost, uploads, s.Token, "application/json", string(manifest), nil); res.StatusCode != http.StatusCreated {
+		t.Fatalf("declare files: status %d", res.StatusCode)
+	}
+	return s, uploads
+}
+
+func patch(t *testing.T, url, token string, offset int, body string) *http.Response {
+	t.Helper()
+	header := http.Header{"Upload-Offset": {strconv.Itoa(offset)}, "Tus-Resumable": {tusVersion}}
+	return request(t, http.MethodPatch, url, token, "application/offset+octet-stream", body, header)
+}
+
+func TestUploadChunkOffset(t *testing.T) {
+	url := newTestServer(t, Config{})
+	s, uploads := createUpload(t, url, "store", "abcdefgh")
+
+	if res := patch(t, uploads+"/0", s.Token, 0, "abc"); res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "3" {
+		t.Fatalf("first chunk: status %d, offset %s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	// a retried chunk is rejected with the offset to resume from
+	if res := patch(t, uploads+"/0", s.Token, 0, "abc"); res.StatusCode != http.StatusConflict || res.Header.Get("Upload-Offset") != "3" {
+		t.Fatalf("retried chunk: status %d, offset %s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	if res := patch(t, uploads+"/0", s.Token, 3, "defgh"); res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "8" {
+		t.Fatalf("last chunk: status %d, offset %s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+
+	var r apiSession
+	res := request(t, http.MethodPost, url+"/connections/"+s.ID+"/join", "", "application/json", "{}", nil)
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	res = request(t, http.MethodGet, url+"/connections/"+s.ID+"/download", r.Token, "", "", nil)
+	if got, _ := io.ReadAll(res.Body); string(got) != "abcdefgh" {
+		t.Errorf("downloaded %q, want %q", got, "abcdefgh")
+	}
+}
+
+func TestUploadChunkWaitsForReceiver(t *testing.T) {
+	url := newTestServer(t, Config{TransferTimeout: 100 * time.Millisecond})
+	s, uploads := createUpload(t, url, "direct", "abc")
+
+	// direct transfers have no receiver yet, the client is asked to retry instead of timing out
+	res := patch(t, uploads+"/0", s.Token, 0, "abc")
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" || res.Header.Get("Upload-Offset") != "0" {
+		t.Fatalf("status %d, Retry-After %q, offset %q", res.StatusCode, res.Header.Get("Retry-After"), res.Header.Get("Upload-Offset"))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/eriicafes/httportal/client"
+	"github.com/eriicafes/httportal/e2e"
+	"github.com/eriicafes/httportal/qr"
+)
+
+func defaultServer() string {
+	if s := os.Getenv("HTTPORTAL_URL"); s != "" {
+		return s
+	}
+	return "http://localhost:8080"
+}
+
+func sendCommand(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "server URL, defaults to $HTTPORTAL_URL")
+	mode := fs.String("mode", "direct", "transfer mode: direct, broadcast or store")
+	passphrase := fs.String("passphrase", "", "passphrase receivers must enter to join")
+	expiry := fs.Duration("expiry", 0, "expire the connection sooner than the server allows, like 10m")
+	receivers := fs.Int("receivers", 0, "number of receivers a broadcast waits for before it starts")
+	encrypt := fs.Bool("encrypt", false, "end-to-end encrypt files, the key is added to the link")
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 {
+		return errors.New("send requires at least one file")
+	}
+
+	files := make([]client.File, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		files[i] = client.File{Name: filepath.Base(path), Reader: f}
+	}
+
+	c := client.New(*server)
+	c.Mode, c.Passphrase, c.Expiry, c.Receivers = *mode, *passphrase, *expiry, *receivers
+	if *encrypt {
+		key, err := e2e.GenerateKey()
+		if err != nil {
+			return err
+		}
+		c.Key = key
+	}
+	bar := &progressBar{w: os.Stderr}
+	c.Created = func(id string) {
+		link := fmt.Sprintf("%s/receive?id=%s", c.BaseURL, url.QueryEscape(id))
+		if c.Key != nil {
+			link += "#" + e2e.EncodeKey(c.Key)
+		}
+		if code, err := qr.Encode(link, qr.Medium); err == nil {
+			fmt.Fprint(os.Stderr, code.Terminal())
+		}
+		fmt.Fprintf(os.Stderr, "Code: %s\nLink: %s\n\n", id, link)
+	}
+	c.Progress = bar.Update
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	_, err := c.SendFiles(ctx, files...)
+	bar.Done()
+	return err
+}
+
+func receiveCommand(args []string) error {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "server URL, defaults to $HTTPORTAL_URL or the server of the link")
+	out := fs.String("o", ".", "directory to write received files to")
+	passphrase := fs.String("passphrase", "", "passphrase of a protected connection")
+	key := fs.String("key", "", "key of an end-to-end encrypted transfer, defaults to the key of the link")
+	codes := parseArgs(fs, args)
+	if len(codes) != 1 {
+		return errors.New("receive requires a code or link")
+	}
+
+	// links carry the server, the code and the key of encrypted transfers
+	id := codes[0]
+	if link, err := url.Parse(id); err == nil && link.Scheme != "" && link.Query().Has("id") {
+		*server = link.Scheme + "://" + link.Host
+		id = link.Query().Get("id")
+		if *key == "" {
+			*key = link.Fragment
+		}
+	}
+
+	c := client.New(*server)
+	c.Passphrase = *passphrase
+	if *key != "" {
+		k, err := e2e.DecodeKey(*key)
+		if err != nil {
+			return err
+		}
+		c.Key = k
+	}
+	bar := &progressBar{w: os.Stderr}
+	c.Progress = bar.Update
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	paths, err := c.ReceiveDir(ctx, id, *out)
+	bar.Done()
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+	return err
+}
+
+// parseArgs parses flags that may come before or after positional arguments and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// progressBar renders transfer progress and the latest activity on a single terminal line.
+type progressBar struct {
+	w       io.Writer
+	mu      sync.Mutex
+	percent int
+	rate    string
+	message string
+	drawn   bool
+}
+
+const progressBarWidth = 30
+
+func (b *progressBar) Update(p client.Progress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p.Message != "" {
+		b.message = p.Message
+	} else {
+		b.percent = min(max(p.Percent, 0), 100)
+		b.rate = p.Rate
+	}
+	filled := b.percent * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	rate := ""
+	if b.rate != "" {
+		rate = " " + b.rate
+	}
+	fmt.Fprintf(b.w, "\r\033[K[%s] %3d%%%s %s", bar, b.percent, rate, b.message)
+	b.drawn = true
+}
+
+func (b *progressBar) Done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drawn {
+		fmt.Fprintln(b.w)
+	}
+}
@@ -0,0 +1,488 @@
+// Package client sends and receives files through an httportal server using its JSON API.
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eriicafes/httportal/e2e"
+)
+
+// ErrChecksumMismatch is returned when a received file does not match the checksum announced by the server.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrEncryptedArchive is returned by ReceiveFile when the server sends an archive of end-to-end encrypted files,
+// its entries are decrypted by ReceiveDir.
+var ErrEncryptedArchive = errors.New("the transfer is an archive of end-to-end encrypted files, receive it as a folder")
+
+// Error is an error returned by the server.
+type Error struct {
+	Message     string `json:"message"`
+	Description string `json:"description"`
+	Status      int    `json:"status"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Description
+}
+
+// Progress is reported from the events of a connection.
+type Progress struct {
+	// Percent is the last reported progress of the transfer.
+	Percent int
+	// Rate is the last reported transfer rate like "1.2 MB/s", it is empty once the transfer completes.
+	Rate string
+	// Message is the last activity message, it is empty for progress events.
+	Message string
+}
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Mode of connections created by Send, one of direct, broadcast or store.
+	Mode string
+	// Passphrase protects connections created by Send and is used to join connections in Receive.
+	Passphrase string
+	// Expiry of connections created by Send, zero is the longest expiry allowed by the server.
+	Expiry time.Duration
+	// Receivers a broadcast created by Send waits for before it starts, zero starts with the first receiver.
+	Receivers int
+	// Key end-to-end encrypts files sent and decrypts files received, see the e2e package.
+	Key []byte
+	// Created is called by Send with the connection ID as soon as it is created,
+	// since direct transfers only complete once a receiver joins.
+	Created func(id string)
+	// Progress is called for every progress and activity event of a transfer.
+	Progress func(Progress)
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+type session struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type status struct {
+	Error string `json:"error"`
+}
+
+// File is a file to send.
+type File struct {
+	Name string
+	// Path is the relative path of the file when sending a folder, Name is used when empty.
+	Path   string
+	Reader io.Reader
+	// Size of the content, it is found from Reader when it has a Len method or is an io.Seeker like *os.File.
+	// The server streams files so receivers need their size up front, only the last file can have an unknown size
+	// and is then streamed until Reader ends, such a transfer can not be received as a tar archive.
+	Size int64
+	// SHA256 is the optional hex encoded checksum of the content, the server fails the transfer if it does not match.
+	// It is the checksum of the encrypted content when the client has a key.
+	SHA256 string
+}
+
+// manifest declares the files of an upload, it is the JSON encoding of the server headers.
+type manifest struct {
+	Files     []manifestFile `json:"files"`
+	Encrypted bool           `json:"encrypted,omitempty"`
+}
+
+type manifestFile struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+	// Size is left out when it is unknown.
+	Size        *int64 `json:"size,omitempty"`
+	ContentType string `json:"contentType"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// Send creates a connection and uploads r as a file named name.
+// It returns the connection ID once the upload completes.
+func (c *Client) Send(ctx context.Context, r io.Reader, name string) (string, error) {
+	return c.SendFiles(ctx, File{Name: name, Reader: r})
+}
+
+// SendFiles creates a connection and uploads files in order.
+// It returns the connection ID once the upload completes.
+func (c *Client) SendFiles(ctx context.Context, files ...File) (string, error) {
+	m, readers, err := c.prepare(files)
+	if err != nil {
+		return "", err
+	}
+	var s session
+	body := map[string]any{"mode": c.Mode, "passphrase": c.Passphrase, "receivers": c.Receivers}
+	if c.Expiry > 0 {
+		body["expiry"] = c.Expiry.String()
+	}
+	if err := c.do(ctx, http.MethodPost, "/connections", "", body, &s); err != nil {
+		return "", err
+	}
+	if c.Created != nil {
+		c.Created(s.ID)
+	}
+	stop := c.subscribe(ctx, s)
+	defer stop()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(c.writeForm(form, m, readers))
+	}()
+	req, err := c.request(ctx, http.MethodPost, "/connections/"+s.ID+"/files", s.Token, pr)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if err := c.send(req, nil); err != nil {
+		return s.ID, err
+	}
+	// uploads that fail after the request was accepted are reported in the status
+	var st status
+	if err := c.do(ctx, http.MethodGet, "/connections/"+s.ID, s.Token, nil, &st); err != nil {
+		return s.ID, err
+	}
+	if st.Error != "" {
+		return s.ID, fmt.Errorf("upload failed: %s", st.Error)
+	}
+	return s.ID, nil
+}
+
+// prepare returns the manifest of files and the readers of their content.
+// Content types are sniffed from the start of each file like the server does.
+func (c *Client) prepare(files []File) (manifest, []io.Reader, error) {
+	m := manifest{Files: make([]manifestFile, len(files)), Encrypted: c.Key != nil}
+	readers := make([]io.Reader, len(files))
+	for i, file := range files {
+		size, ok := fileSize(file)
+		if !ok && i != len(files)-1 {
+			return m, nil, fmt.Errorf("size of %s is unknown, only the last file can be sent without a size", file.Name)
+		}
+		if ok && c.Key != nil {
+			size = e2e.EncryptedSize(size)
+		}
+		br := bufio.NewReaderSize(file.Reader, 512)
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return m, nil, err
+		}
+		path := file.Path
+		if path == "" {
+			path = file.Name
+		}
+		m.Files[i] = manifestFile{
+			Filename:    file.Name,
+			Path:        path,
+			ContentType: http.DetectContentType(head),
+			SHA256:      file.SHA256,
+		}
+		if ok {
+			m.Files[i].Size = &size
+		}
+		readers[i] = br
+	}
+	return m, readers, nil
+}
+
+// fileSize returns the size of the remaining content of file, it reports false if the size is unknown.
+func fileSize(file File) (int64, bool) {
+	if file.Size > 0 {
+		return file.Size, true
+	}
+	switch r := file.Reader.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			break
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			break
+		}
+		if _, err = r.Seek(current, io.SeekStart); err != nil {
+			break
+		}
+		return end - current, true
+	}
+	return 0, false
+}
+
+func (c *Client) writeForm(form *multipart.Writer, m manifest, readers []io.Reader) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := form.WriteField("manifest", string(b)); err != nil {
+		return err
+	}
+	for i, file := range m.Files {
+		part, err := form.CreateFormFile("file", file.Filename)
+		if err != nil {
+			return err
+		}
+		if err = c.copyFile(part, readers[i], i); err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
+
+// copyFile copies the file at index to w, encrypting it when the client has a key.
+func (c *Client) copyFile(w io.Writer, r io.Reader, index int) error {
+	if c.Key == nil {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	ew, err := e2e.NewWriter(w, c.Key, index)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(ew, r); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// Receive joins connection id and writes the received file to w.
+// Broadcasts of multiple files are received as a zip archive, or fail with ErrEncryptedArchive when they are encrypted.
+func (c *Client) Receive(ctx context.Context, id string, w io.Writer) error {
+	_, err := c.ReceiveFile(ctx, id, "", w)
+	return err
+}
+
+// ReceiveFile joins connection id and writes the received file to w, it returns the name of the file.
+// Query is appended to the download URL, like archive=tar to receive all files as an archive.
+func (c *Client) ReceiveFile(ctx context.Context, id string, query string, w io.Writer) (string, error) {
+	res, stop, err := c.download(ctx, id, query)
+	if err != nil {
+		return "", err
+	}
+	defer stop()
+	defer res.Body.Close()
+	name := filename(res.Header.Get("Content-Disposition"))
+
+	// the checksum covers the bytes relayed by the server, before decryption
+	hash := sha256.New()
+	body := io.TeeReader(res.Body, hash)
+	content := body
+	if res.Header.Get("X-Encrypted") == "true" {
+		// archives have no index since each entry is encrypted with its own
+		index, err := strconv.Atoi(res.Header.Get("X-File-Index"))
+		if err != nil {
+			return name, ErrEncryptedArchive
+		}
+		if content, err = c.decrypt(body, index); err != nil {
+			return name, err
+		}
+	}
+	if _, err = io.Copy(w, content); err != nil {
+		return name, err
+	}
+	// trailers are only available once the body is drained
+	if _, err = io.Copy(io.Discard, body); err != nil {
+		return name, err
+	}
+	return name, verifyDigest(res, hash.Sum(nil))
+}
+
+// verifyDigest compares sum with the Repr-Digest trailer or header of res, if any.
+func verifyDigest(res *http.Response, sum []byte) error {
+	digest := res.Trailer.Get("Repr-Digest")
+	if digest == "" {
+		digest = res.Header.Get("Repr-Digest")
+	}
+	for _, field := range strings.Split(digest, ",") {
+		b64, ok := strings.CutPrefix(strings.TrimSpace(field), "sha-256=:")
+		if ok && strings.TrimSuffix(b64, ":") != base64.StdEncoding.EncodeToString(sum) {
+			return ErrChecksumMismatch
+		}
+	}
+	return nil
+}
+
+// ReceiveDir joins connection id and writes all received files into dir at their relative paths.
+// It returns the paths of the files written.
+func (c *Client) ReceiveDir(ctx context.Context, id string, dir string) ([]string, error) {
+	res, stop, err := c.download(ctx, id, "archive=tar")
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer res.Body.Close()
+	encrypted := res.Header.Get("X-Encrypted") == "true"
+
+	var paths []string
+	tr := tar.NewReader(res.Body)
+	// archives contain all files in order, encrypted files are decrypted with their index
+	var index int
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return paths, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// paths are sanitized by the server but a client should not trust it
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return paths, fmt.Errorf("invalid file path %q", header.Name)
+		}
+		path := filepath.Join(dir, name)
+		var content io.Reader = tr
+		if encrypted {
+			if content, err = c.decrypt(tr, index); err != nil {
+				return paths, err
+			}
+		}
+		if err = writeFile(path, content); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+		index++
+	}
+}
+
+// download joins connection id and starts the download, stop must be called once the body is read.
+func (c *Client) download(ctx context.Context, id string, query string) (*http.Response, func(), error) {
+	var s session
+	body := map[string]string{"passphrase": c.Passphrase}
+	if err := c.do(ctx, http.MethodPost, "/connections/"+url.PathEscape(id)+"/join", "", body, &s); err != nil {
+		return nil, nil, err
+	}
+	stop := c.subscribe(ctx, s)
+
+	path := "/connections/" + url.PathEscape(s.ID) + "/download"
+	if query != "" {
+		path += "?" + query
+	}
+	req, err := c.request(ctx, http.MethodGet, path, s.Token, nil)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		stop()
+		return nil, nil, decodeError(res)
+	}
+	return res, stop, nil
+}
+
+func (c *Client) decrypt(r io.Reader, index int) (io.Reader, error) {
+	if c.Key == nil {
+		return nil, errors.New("the transfer is end-to-end encrypted, a key is required")
+	}
+	return e2e.NewReader(r, c.Key, index)
+}
+
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.request(ctx, method, path, token, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, v)
+}
+
+func (c *Client) request(ctx context.Context, method, path, token string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+"/api/v1"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (c *Client) send(req *http.Request, v any) error {
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return decodeError(res)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func decodeError(res *http.Response) error {
+	var body struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil || body.Error == nil {
+		return &Error{Message: http.StatusText(res.StatusCode), Status: res.StatusCode}
+	}
+	return body.Error
+}
+
+func filename(disposition string) string {
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eriicafes/httportal/app"
+	"github.com/eriicafes/httportal/e2e"
+)
+
+func newServer(t *testing.T) string {
+	t.Helper()
+	store, err := app.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := app.NewIDGenerator("", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	app.New(nil, app.NewPortal(store, time.Hour, ids, app.Timeouts{}), app.Config{}).Mount(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// send sends files in the background and returns the connection ID once it is created.
+// Errors of the send are reported on the returned channel.
+func send(t *testing.T, c *Client, files ...File) (string, <-chan error) {
+	t.Helper()
+	created := make(chan string, 1)
+	c.Created = func(id string) { created <- id }
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.SendFiles(context.Background(), files...)
+		errc <- err
+	}()
+	select {
+	case id := <-created:
+		return id, errc
+	case err := <-errc:
+		t.Fatalf("send: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not created")
+	}
+	return "", nil
+}
+
+func wait(t *testing.T, errc <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("send did not complete")
+		return nil
+	}
+}
+
+func TestDirect(t *testing.T) {
+	url := newServer(t)
+	content := bytes.Repeat([]byte("hello world "), 10000)
+	id, errc := send(t, New(url), File{Name: "hello.txt", Reader: bytes.NewReader(content)})
+
+	var buf bytes.Buffer
+	name, err := New(url).ReceiveFile(context.Background(), id, "", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wait(t, errc); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if name != "hello.txt" || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("received %q with %d bytes, want hello.txt with %d bytes", name, buf.Len(), len(content))
+	}
+}
+
+func TestDirectUnknownSize(t *testing.T) {
+	url := newServer(t)
+	content := []byte("streamed until the reader ends")
+	// a reader without a Len method or Seek has an unknown size
+	id, errc := send(t, New(url), File{Name: "stream.txt", Reader: io.MultiReader(bytes.NewReader(content))})
+
+	var buf bytes.Buffer
+	if err := New(url).Receive(context.Background(), id, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, errc); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("received %q, want %q", buf.Bytes(), content)
+	}
+}
+
+func TestDirectEncrypted(t *testing.T) {
+	url := newServer(t)
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, receiver := New(url), New(url)
+	sender.Key, receiver.Key = key, key
+	files := map[string]string{"a.txt": "first file", "dir/b.txt": strings.Repeat("second file ", e2e.ChunkSize/8)}
+	id, errc := send(t, sender,
+		File{Name: "a.txt", Reader: strings.NewReader(files["a.txt"])},
+		File{Name: "b.txt", Path: "dir/b.txt", Reader: strings.NewReader(files["dir/b.txt"])},
+	)
+
+	dir := t.TempDir()
+	paths, err := receiver.ReceiveDir(context.Background(), id, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wait(t, errc); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	checkDir(t, dir, paths, files)
+}
+
+func TestBroadcastEncrypted(t *testing.T) {
+	url := newServer(t)
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := New(url)
+	sender.Mode, sender.Key, sender.Receivers = "broadcast", key, 2
+	files := map[string]string{"a.txt": "first file", "dir/b.txt": strings.Repeat("second file ", e2e.ChunkSize/8)}
+	id, errc := send(t, sender,
+		File{Name: "a.txt", Reader: strings.NewReader(files["a.txt"])},
+		File{Name: "b.txt", Path: "dir/b.txt", Reader: strings.NewReader(files["dir/b.txt"])},
+	)
+
+	// archives of encrypted files are decrypted entry by entry, not as a single file
+	receiver := New(url)
+	receiver.Key = key
+	received := make(chan error, 1)
+	go func() {
+		received <- receiver.Receive(context.Background(), id, io.Discard)
+	}()
+	dir := t.TempDir()
+	paths, err := receiver.ReceiveDir(context.Background(), id, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-received; !errors.Is(err, ErrEncryptedArchive) {
+		t.Errorf("receive as a single file: got %v, want ErrEncryptedArchive", err)
+	}
+	if err = wait(t, errc); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	checkDir(t, dir, paths, files)
+}
+
+func TestMultipleFiles(t *testing.T) {
+	url := newServer(t)
+	files := map[string]string{"a.txt": "first file", "docs/b.md": "# second file", "docs/c/d.bin": "\x00\x01\x02"}
+	id, errc := send(t, New(url),
+		File{Name: "a.txt", Reader: strings.NewReader(files["a.txt"])},
+		File{Name: "b.md", Path: "docs/b.md", Reader: strings.NewReader(files["docs/b.md"])},
+		File{Name: "d.bin", Path: "docs/c/d.bin", Reader: strings.NewReader(files["docs/c/d.bin"])},
+	)
+
+	dir := t.TempDir()
+	paths, err := New(url).ReceiveDir(context.Background(), id, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wait(t, errc); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	checkDir(t, dir, paths, files)
+}
+
+func TestStore(t *testing.T) {
+	url := newServer(t)
+	sender := New(url)
+	sender.Mode = "store"
+	sender.Passphrase = "correct horse"
+	content := []byte("stored until a receiver downloads it")
+	sum := sha256.Sum256(content)
+
+	// stored sends complete without a receiver
+	id, err := sender.SendFiles(context.Background(), File{Name: "stored.txt", Reader: bytes.NewReader(content), SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cerr *Error
+	if err = New(url).Receive(context.Background(), id, io.Discard); !errors.As(err, &cerr) {
+		t.Errorf("receive without passphrase: got %v, want a server error", err)
+	}
+	receiver := New(url)
+	receiver.Passphrase = sender.Passphrase
+	var buf bytes.Buffer
+	if err = receiver.Receive(context.Background(), id, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("received %q, want %q", buf.Bytes(), content)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	url := newServer(t)
+	sender := New(url)
+	sender.Mode = "store"
+	sum := sha256.Sum256([]byte("other content"))
+	_, err := sender.SendFiles(context.Background(), File{Name: "a.txt", Reader: strings.NewReader("content"), SHA256: hex.EncodeToString(sum[:])})
+	var cerr *Error
+	if !errors.As(err, &cerr) || cerr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("got %v, want a %d error", err, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	other := sha256.Sum256([]byte("other content"))
+	res := &http.Response{Header: http.Header{}, Trailer: http.Header{}}
+	if err := verifyDigest(res, sum[:]); err != nil {
+		t.Errorf("no digest: %v", err)
+	}
+	res.Trailer.Set("Repr-Digest", "sha-512=:abc:, sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	if err := verifyDigest(res, sum[:]); err != nil {
+		t.Errorf("matching digest: %v", err)
+	}
+	if err := verifyDigest(res, other[:]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("mismatched digest: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func checkDir(t *testing.T, dir string, paths []string, files map[string]string) {
+	t.Helper()
+	if len(paths) != len(files) {
+		t.Errorf("received %d files, want %d", len(paths), len(files))
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %d bytes, want %d", path, len(got), len(want))
+		}
+	}
+}
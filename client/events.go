@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// subscribe reports the events of a connection to the Progress callback until stop is called.
+func (c *Client) subscribe(ctx context.Context, s session) (stop func()) {
+	if c.Progress == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := c.request(ctx, http.MethodGet, "/connections/"+s.ID+"/events", s.Token, nil)
+		if err != nil {
+			return
+		}
+		res, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return
+		}
+		var progress Progress
+		var event, data string
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			case line == "":
+				switch event {
+				case "":
+					progress.Message = data
+					c.Progress(progress)
+				case "progress":
+					// progress is followed by the rate while the transfer is running, like "42% 1.2 MB/s"
+					percent, rate, _ := strings.Cut(data, " ")
+					if n, err := strconv.Atoi(strings.TrimSuffix(percent, "%")); err == nil {
+						progress.Percent, progress.Rate, progress.Message = n, rate, ""
+						c.Progress(progress)
+					}
+				case "close":
+					return
+				}
+				event, data = "", ""
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,229 @@
+// Package e2e implements the chunked AES-GCM stream format used for end-to-end encrypted transfers.
+//
+// The plaintext is split into chunks of ChunkSize bytes, only the last chunk may be shorter
+// (an empty plaintext is a single empty chunk). Each chunk is sealed with AES-256-GCM and written as a record:
+//
+//	header     4 bytes, big endian: the high bit is set on the last record, the low 31 bits are the sealed length
+//	sealed     chunk ciphertext followed by the 16 byte tag
+//
+// The 12 byte nonce of a record is the index of the file in the transfer as a 3 byte big endian integer,
+// the record counter as an 8 byte big endian integer and a byte set to 1 on the last record and 0 otherwise,
+// so records can not be reordered, dropped or truncated, nor swapped between the files of a transfer.
+// Since the nonce is derived from the file index and counter a key must only ever be used for a single transfer,
+// and each file of the transfer must be encrypted with its own index.
+//
+// The key is 32 random bytes, shared as unpadded base64url in the URL fragment so it never reaches the server.
+// The browser implementation lives in resources/e2e.ts.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	KeySize   = 32
+	ChunkSize = 64 * 1024
+	// Overhead is the number of bytes added to each chunk.
+	Overhead = headerSize + tagSize
+
+	headerSize = 4
+	tagSize    = 16
+	nonceSize  = 12
+	lastFlag   = 1 << 31
+	// MaxFiles is the number of files that can be encrypted with a key.
+	MaxFiles = 1 << 24
+)
+
+var (
+	ErrInvalidKey    = errors.New("e2e: invalid key")
+	ErrInvalidIndex  = errors.New("e2e: invalid file index")
+	ErrInvalidRecord = errors.New("e2e: invalid record")
+	ErrTruncated     = errors.New("e2e: stream truncated")
+)
+
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// EncryptedSize returns the size of the stream for a plaintext of n bytes.
+func EncryptedSize(n int64) int64 {
+	records := (n + ChunkSize - 1) / ChunkSize
+	if records == 0 {
+		records = 1
+	}
+	return n + records*Overhead
+}
+
+func newAEAD(key []byte, index int) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	if index < 0 || index >= MaxFiles {
+		return nil, ErrInvalidIndex
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(index int, counter uint64, last bool) []byte {
+	n := make([]byte, nonceSize)
+	n[0], n[1], n[2] = byte(index>>16), byte(index>>8), byte(index)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	index   int
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewWriter returns a writer that encrypts the file at index of a transfer to w.
+// Close must be called to write the last record, it does not close w.
+func NewWriter(w io.Writer, key []byte, index int) (io.WriteCloser, error) {
+	aead, err := newAEAD(key, index)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, index: index, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("e2e: write to closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, so the last chunk is never empty unless the stream is
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *writer) seal(last bool) error {
+	record := make([]byte, headerSize, headerSize+len(w.buf)+tagSize)
+	record = w.aead.Seal(record, nonce(w.index, w.counter, last), w.buf, nil)
+	header := uint32(len(record) - headerSize)
+	if last {
+		header |= lastFlag
+	}
+	binary.BigEndian.PutUint32(record, header)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(record)
+	return err
+}
+
+type reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	index   int
+	buf     []byte
+	sealed  []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewReader returns a reader that decrypts the file at index of a transfer from r.
+// The reader returns ErrTruncated if r ends before the last record.
+func NewReader(r io.Reader, key []byte, index int) (io.Reader, error) {
+	aead, err := newAEAD(key, index)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r: r, aead: aead, index: index, sealed: make([]byte, ChunkSize+tagSize)}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) open() error {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	h := binary.BigEndian.Uint32(header[:])
+	last, size := h&lastFlag != 0, int(h&^lastFlag)
+	if size < tagSize || size > ChunkSize+tagSize {
+		return ErrInvalidRecord
+	}
+	sealed := r.sealed[:size]
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	plain, err := r.aead.Open(sealed[:0], nonce(r.index, r.counter, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	r.counter++
+	r.buf = plain
+	r.done = last
+	return nil
+}
@@ -0,0 +1,138 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, plain []byte, index int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key, sealed []byte, index int) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key, index)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		plain := make([]byte, n)
+		rand.Read(plain)
+		sealed := encrypt(t, key, plain, 7)
+		if int64(len(sealed)) != EncryptedSize(int64(n)) {
+			t.Errorf("size %d: encrypted %d bytes, EncryptedSize is %d", n, len(sealed), EncryptedSize(int64(n)))
+		}
+		got, err := decrypt(key, sealed, 7)
+		if err != nil {
+			t.Fatalf("size %d: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted content differs", n)
+		}
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	key, _ := GenerateKey()
+	sealed := encrypt(t, key, nil, 0)
+	if len(sealed) != Overhead {
+		t.Fatalf("empty stream is %d bytes, want a single record of %d", len(sealed), Overhead)
+	}
+	// an empty stream is not the same as a missing one
+	if _, err := decrypt(key, nil, 0); !errors.Is(err, ErrTruncated) {
+		t.Errorf("missing stream: got %v, want ErrTruncated", err)
+	}
+}
+
+func TestWrongIndex(t *testing.T) {
+	key, _ := GenerateKey()
+	sealed := encrypt(t, key, []byte("hello"), 1)
+	if _, err := decrypt(key, sealed, 2); !errors.Is(err, ErrInvalidRecord) {
+		t.Errorf("got %v, want ErrInvalidRecord", err)
+	}
+	for _, index := range []int{-1, MaxFiles} {
+		if _, err := NewWriter(io.Discard, key, index); !errors.Is(err, ErrInvalidIndex) {
+			t.Errorf("index %d: got %v, want ErrInvalidIndex", index, err)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key, _ := GenerateKey()
+	other, _ := GenerateKey()
+	sealed := encrypt(t, key, []byte("hello"), 0)
+	if _, err := decrypt(other, sealed, 0); !errors.Is(err, ErrInvalidRecord) {
+		t.Errorf("got %v, want ErrInvalidRecord", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key, _ := GenerateKey()
+	plain := make([]byte, 2*ChunkSize+10)
+	rand.Read(plain)
+	sealed := encrypt(t, key, plain, 0)
+	record := ChunkSize + Overhead
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		want   error
+	}{
+		{"dropped last record", sealed[:2*record], ErrTruncated},
+		{"cut inside a record", sealed[:record+10], ErrTruncated},
+		{"dropped first record", sealed[record:], ErrInvalidRecord},
+		{"swapped records", concat(sealed[record:2*record], sealed[:record], sealed[2*record:]), ErrInvalidRecord},
+		{"flipped bit", flip(sealed, record+100), ErrInvalidRecord},
+		{"last flag on first record", flip(sealed, 0), ErrInvalidRecord},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(key, tt.sealed, 0); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key, _ := GenerateKey()
+	decoded, err := DecodeKey(EncodeKey(key))
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Fatalf("got %x, %v, want %x", decoded, err, key)
+	}
+	if _, err := DecodeKey(EncodeKey(key[:16])); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("short key: got %v, want ErrInvalidKey", err)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func flip(b []byte, i int) []byte {
+	b = bytes.Clone(b)
+	b[i] ^= 0x80
+	return b
+}
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
+
+	"github.com/eriicafes/httportal/app"
 )
 
 type Port int
@@ -20,8 +24,34 @@ func (ne NodeEnv) IsProduction() bool {
 }
 
 type Envs struct {
-	Port    Port
-	NodeEnv NodeEnv
+	Port     Port
+	NodeEnv  NodeEnv
+	StoreDir string
+	StoreTTL time.Duration
+	// UnjoinedTimeout, IdleTimeout and MaxLifetime bound how long connections are kept, see app.Timeouts.
+	UnjoinedTimeout time.Duration
+	IdleTimeout     time.Duration
+	MaxLifetime     time.Duration
+	// TransferTimeout bounds each upload and download request.
+	TransferTimeout time.Duration
+	// SessionTTL is how long peer sessions are valid.
+	SessionTTL time.Duration
+	// ID_FORMAT, ID_LENGTH and ID_ALPHABET configure connection IDs, see app.NewIDGenerator.
+	IDFormat   string
+	IDLength   int
+	IDAlphabet string
+	// SecretKeys are the keys signing session cookies from SECRET_KEYS or the file at SECRET_KEYS_FILE, see app.ParseKeyring.
+	SecretKeys string
+	// RateConnection, RateIP and RateGlobal limit transfers in bytes per second, see app.ParseRate.
+	RateConnection int64
+	RateIP         int64
+	RateGlobal     int64
+	// TrustProxy identifies clients by X-Forwarded-For when the server runs behind a reverse proxy.
+	TrustProxy bool
+	// MaxFileSize, AllowTypes and DenyTypes restrict uploaded files, see app.Policy.
+	MaxFileSize int64
+	AllowTypes  []string
+	DenyTypes   []string
 }
 
 func GetEnvs() Envs {
@@ -29,8 +59,74 @@ func GetEnvs() Envs {
 	if err != nil {
 		log.Fatalf("Invalid port %q", port)
 	}
+	storeDir := os.Getenv("STORE_DIR")
+	if storeDir == "" {
+		storeDir = filepath.Join(os.TempDir(), "httportal")
+	}
+	storeTTL := time.Hour
+	if s := os.Getenv("STORE_TTL"); s != "" {
+		if storeTTL, err = time.ParseDuration(s); err != nil {
+			log.Fatalf("Invalid store ttl %q", s)
+		}
+	}
+	// zero durations use the defaults of the app package
+	durations := make([]time.Duration, 5)
+	for i, key := range []string{"UNJOINED_TIMEOUT", "IDLE_TIMEOUT", "MAX_LIFETIME", "TRANSFER_TIMEOUT", "SESSION_TTL"} {
+		if s := os.Getenv(key); s != "" {
+			if durations[i], err = time.ParseDuration(s); err != nil || durations[i] <= 0 {
+				log.Fatalf("Invalid %s %q", key, s)
+			}
+		}
+	}
+	var idLength int
+	if s := os.Getenv("ID_LENGTH"); s != "" {
+		if idLength, err = strconv.Atoi(s); err != nil {
+			log.Fatalf("Invalid id length %q", s)
+		}
+	}
+	secretKeys := os.Getenv("SECRET_KEYS")
+	if file := os.Getenv("SECRET_KEYS_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Invalid secret keys file %q: %v", file, err)
+		}
+		secretKeys = string(b)
+	}
+	rates := make([]int64, 3)
+	for i, key := range []string{"RATE_LIMIT_CONNECTION", "RATE_LIMIT_IP", "RATE_LIMIT_GLOBAL"} {
+		if rates[i], err = app.ParseRate(os.Getenv(key)); err != nil {
+			log.Fatalf("Invalid %s: %v", key, err)
+		}
+	}
+	trustProxy, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY"))
+	maxFileSize, err := app.ParseSize(os.Getenv("MAX_FILE_SIZE"))
+	if err != nil {
+		log.Fatalf("Invalid MAX_FILE_SIZE: %v", err)
+	}
 	return Envs{
-		Port:    Port(port),
-		NodeEnv: NodeEnv(os.Getenv("NODE_ENV")),
+		Port:     Port(port),
+		NodeEnv:  NodeEnv(os.Getenv("NODE_ENV")),
+		StoreDir: storeDir,
+		StoreTTL: storeTTL,
+
+		UnjoinedTimeout: durations[0],
+		IdleTimeout:     durations[1],
+		MaxLifetime:     durations[2],
+		TransferTimeout: durations[3],
+		SessionTTL:      durations[4],
+
+		IDFormat:   os.Getenv("ID_FORMAT"),
+		IDLength:   idLength,
+		IDAlphabet: os.Getenv("ID_ALPHABET"),
+		SecretKeys: secretKeys,
+
+		RateConnection: rates[0],
+		RateIP:         rates[1],
+		RateGlobal:     rates[2],
+		TrustProxy:     trustProxy,
+
+		MaxFileSize: maxFileSize,
+		AllowTypes:  app.ParsePolicyList(os.Getenv("ALLOW_TYPES")),
+		DenyTypes:   app.ParsePolicyList(os.Getenv("DENY_TYPES")),
 	}
 }
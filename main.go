@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/eriicafes/httportal/app"
 	"github.com/eriicafes/httportal/vite"
@@ -11,6 +13,36 @@ import (
 )
 
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "serve":
+		serve()
+	case "send":
+		err = sendCommand(args)
+	case "receive":
+		err = receiveCommand(args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+const usage = `Usage:
+  httportal serve                       start the web server
+  httportal send [flags] <file...>      send files and print the code to receive them
+  httportal receive [flags] <code|link> receive files into a directory
+
+Run a command with -h to list its flags.`
+
+func serve() {
 	envs := GetEnvs()
 	vite, err := vite.New("dist", "public", "static", "5173", !envs.NodeEnv.IsProduction())
 	if err != nil {
@@ -23,7 +55,38 @@ func main() {
 		Autoload("components", "partials").
 		LoadWithLayouts("pages").
 		MustParse()
-	app := app.New(tp, app.NewPortal())
+	if envs.SecretKeys != "" {
+		keyring, err := app.ParseKeyring(envs.SecretKeys)
+		if err != nil {
+			panic(err)
+		}
+		app.SetKeyring(keyring)
+	} else {
+		log.Println("SECRET_KEYS is not set, sessions will not survive a restart")
+	}
+	store, err := app.NewFSStore(envs.StoreDir)
+	if err != nil {
+		panic(err)
+	}
+	if n, err := store.Clear(); err != nil {
+		log.Printf("failed to clear store: %v", err)
+	} else if n > 0 {
+		log.Printf("cleared %d blobs left in store by a previous run", n)
+	}
+	ids, err := app.NewIDGenerator(envs.IDFormat, envs.IDLength, envs.IDAlphabet)
+	if err != nil {
+		panic(err)
+	}
+	config := app.Config{
+		Throttle:   app.ThrottleOptions{Connection: envs.RateConnection, IP: envs.RateIP, Global: envs.RateGlobal},
+		Policy:     app.Policy{MaxFileSize: envs.MaxFileSize, Allow: envs.AllowTypes, Deny: envs.DenyTypes},
+		TrustProxy: envs.TrustProxy,
+
+		TransferTimeout: envs.TransferTimeout,
+		SessionTTL:      envs.SessionTTL,
+	}
+	timeouts := app.Timeouts{Unjoined: envs.UnjoinedTimeout, Idle: envs.IdleTimeout, Lifetime: envs.MaxLifetime}
+	app := app.New(tp, app.NewPortal(store, envs.StoreTTL, ids, timeouts), config)
 
 	app.Mount(http.DefaultServeMux)
 	http.Handle("GET /static/", http.StripPrefix("/static", vite.FileServer()))
@@ -0,0 +1,130 @@
+package qr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		data  int
+		level Level
+		size  int
+	}{
+		{17, Low, 21},
+		{18, Low, 25},
+		{14, Medium, 21},
+		{15, Medium, 25},
+		{7, High, 21},
+		{2953, Low, 177},
+	}
+	for _, tt := range tests {
+		code, err := Encode(strings.Repeat("a", tt.data), tt.level)
+		if err != nil {
+			t.Fatalf("%d bytes at level %d: %v", tt.data, tt.level, err)
+		}
+		if code.Size != tt.size {
+			t.Errorf("%d bytes at level %d: size %d, want %d", tt.data, tt.level, code.Size, tt.size)
+		}
+	}
+	if _, err := Encode(strings.Repeat("a", 2954), Low); !errors.Is(err, ErrTooLong) {
+		t.Errorf("got %v, want ErrTooLong", err)
+	}
+}
+
+func TestFunctionPatterns(t *testing.T) {
+	code, err := Encode("https://example.com/connections/abc", Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := code.Size
+	for _, corner := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for y := -1; y <= 7; y++ {
+			for x := -1; x <= 7; x++ {
+				// finder patterns are rings of 7, 5 and 3 modules surrounded by a light separator
+				d := max(abs(x-3), abs(y-3))
+				want := d != 2 && d != 4
+				if got := code.Dark(corner[0]+x, corner[1]+y); got != want {
+					t.Fatalf("finder at %v: module %d,%d is %v, want %v", corner, x, y, got, want)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if code.Dark(i, 6) != (i%2 == 0) || code.Dark(6, i) != (i%2 == 0) {
+			t.Fatalf("timing pattern is broken at %d", i)
+		}
+	}
+	if !code.Dark(8, size-8) {
+		t.Error("dark module is light")
+	}
+}
+
+// formats are the format information of each mask from the specification, most significant bit first.
+var formats = map[Level][8]string{
+	Low:    {"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+	Medium: {"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+}
+
+func TestFormatInformation(t *testing.T) {
+	for level, masks := range formats {
+		code, err := Encode("hello", level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := code.Size
+		var first, second strings.Builder
+		for i := 14; i >= 0; i-- {
+			var x, y int
+			switch {
+			case i <= 5:
+				x, y = 8, i
+			case i <= 7:
+				x, y = 8, i+1
+			case i == 8:
+				x, y = 7, 8
+			default:
+				x, y = 14-i, 8
+			}
+			first.WriteString(bit(code.Dark(x, y)))
+			if i < 8 {
+				x, y = size-1-i, 8
+			} else {
+				x, y = 8, size-15+i
+			}
+			second.WriteString(bit(code.Dark(x, y)))
+		}
+		if first.String() != second.String() {
+			t.Errorf("level %d: format copies differ, %s and %s", level, first.String(), second.String())
+		}
+		found := false
+		for _, format := range masks {
+			found = found || format == first.String()
+		}
+		if !found {
+			t.Errorf("level %d: format %s is not valid for the level", level, first.String())
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	code, err := Encode("hello", Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svg := code.SVG(); !strings.HasPrefix(svg, "<svg") {
+		t.Errorf("SVG does not start with an svg element: %.40q", svg)
+	}
+	lines := strings.Count(code.Terminal(), "\n")
+	if want := (code.Size + QuietZone*2 + 1) / 2; lines != want {
+		t.Errorf("Terminal has %d lines, want %d", lines, want)
+	}
+}
+
+func bit(dark bool) string {
+	if dark {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,60 @@
+package qr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QuietZone is the width in modules of the light border scanners need around a code.
+const QuietZone = 4
+
+// SVG renders the code with a quiet zone, one user unit per module so it scales to any size.
+func (c *Code) SVG() string {
+	size := c.Size + QuietZone*2
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+			// draw runs of dark modules as a single rectangle
+			run := 1
+			for c.Dark(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x+QuietZone, y+QuietZone, run, run)
+			x += run - 1
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// Terminal renders the code with half block characters, two rows of modules per line.
+// Light modules are drawn in the foreground color so it scans on terminals with a dark background.
+func (c *Code) Terminal() string {
+	var b strings.Builder
+	for y := -QuietZone; y < c.Size+QuietZone; y += 2 {
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			top, bottom := !c.Dark(x, y), !c.Dark(x, y+1)
+			// an odd number of rows leaves the last half line empty
+			if y+1 == c.Size+QuietZone {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
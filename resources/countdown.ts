@@ -0,0 +1,23 @@
+import Alpine from "alpinejs";
+
+/**
+ * Count down to expiresAt every second, formatted as h:mm:ss or m:ss.
+ */
+Alpine.data("countdown", (expiresAt: string) => ({
+  left: 0,
+  timer: 0,
+  init() {
+    const tick = () => (this.left = Math.max(0, Math.round((Date.parse(expiresAt) - Date.now()) / 1000)));
+    tick();
+    this.timer = window.setInterval(tick, 1000);
+  },
+  destroy() {
+    clearInterval(this.timer);
+  },
+  get remaining() {
+    const hours = Math.floor(this.left / 3600);
+    const minutes = Math.floor((this.left % 3600) / 60);
+    const seconds = String(this.left % 60).padStart(2, "0");
+    return hours ? `${hours}:${String(minutes).padStart(2, "0")}:${seconds}` : `${minutes}:${seconds}`;
+  },
+}));
@@ -0,0 +1,67 @@
+import { decryptRecords, decryptStream, importKey, readFull } from "./e2e";
+import { readTar, writeTar } from "./tar";
+
+/**
+ * Download a file and save it, decrypting it with key when the server marks it as end-to-end encrypted.
+ * Archives of encrypted files are saved as a tar archive of the decrypted files.
+ */
+export async function download(url: string, key: string) {
+  const res = await fetch(url);
+  if (!res.ok || !res.body) throw new Error("Download failed");
+  const filename = parseFilename(res.headers.get("Content-Disposition")) || "download";
+  const type = res.headers.get("Content-Type") || "application/octet-stream";
+
+  let parts: BlobPart[];
+  const index = res.headers.get("X-File-Index");
+  if (res.headers.get("X-Encrypted") !== "true") {
+    parts = [await res.blob()];
+  } else if (index !== null) {
+    // each file of a transfer is encrypted with its index
+    parts = [];
+    for await (const part of decryptStream(res.body, await importKey(key), Number(index))) {
+      parts.push(part);
+    }
+  } else if (type === "application/x-tar") {
+    parts = await decryptTar(res.body, await importKey(key));
+  } else {
+    res.body.cancel();
+    throw new Error("Encrypted files can only be downloaded one at a time or as a tar archive");
+  }
+
+  const link = document.createElement("a");
+  link.href = URL.createObjectURL(new Blob(parts, { type }));
+  link.download = filename;
+  link.click();
+  setTimeout(() => URL.revokeObjectURL(link.href), 60_000);
+}
+
+/** Decrypt the entries of a tar archive of encrypted files, each entry is encrypted with its index in the archive. */
+async function decryptTar(body: ReadableStream<Uint8Array>, key: CryptoKey) {
+  const files: { path: string; content: Uint8Array[] }[] = [];
+  await readTar(readFull(body), async (entry) => {
+    const content: Uint8Array[] = [];
+    for await (const part of decryptRecords(entry.read, key, files.length)) {
+      content.push(part);
+    }
+    files.push({ path: entry.path, content });
+  });
+  return writeTar(files);
+}
+
+function parseFilename(disposition: string | null) {
+  if (!disposition) return "";
+  const encoded = /filename\*=utf-8''([^;]+)/i.exec(disposition);
+  if (encoded) return decodeURIComponent(encoded[1]);
+  const plain = /filename="?([^";]+)"?/i.exec(disposition);
+  return plain ? plain[1] : "";
+}
+
+// the key is carried in the URL fragment which is never sent to the server,
+// downloads are decrypted in the browser when it is present
+document.addEventListener("click", (event) => {
+  const key = window.location.hash.slice(1);
+  const link = (event.target as Element | null)?.closest<HTMLAnchorElement>("a[download]");
+  if (!key || !link || !link.pathname.startsWith("/transfer/") || link.search.includes("archive")) return;
+  event.preventDefault();
+  download(link.href, key).catch((err) => alert(err.message));
+});
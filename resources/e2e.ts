@@ -0,0 +1,122 @@
+// Chunked AES-GCM stream format for end-to-end encrypted transfers, see the e2e Go package for the specification.
+const CHUNK_SIZE = 64 * 1024;
+const TAG_SIZE = 16;
+const HEADER_SIZE = 4;
+const OVERHEAD = HEADER_SIZE + TAG_SIZE;
+const RECORD_SIZE = CHUNK_SIZE + OVERHEAD;
+const LAST_FLAG = 0x80000000;
+
+export function generateKey() {
+  const key = crypto.getRandomValues(new Uint8Array(32));
+  return btoa(String.fromCharCode(...key)).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+export function importKey(encoded: string) {
+  const binary = atob(encoded.replace(/-/g, "+").replace(/_/g, "/"));
+  const key = Uint8Array.from(binary, (c) => c.charCodeAt(0));
+  if (key.length !== 32) throw new Error("Invalid encryption key");
+  return crypto.subtle.importKey("raw", key, "AES-GCM", false, ["encrypt", "decrypt"]);
+}
+
+/** Size of the encrypted stream for a plaintext of size bytes. */
+export function encryptedSize(size: number) {
+  return size + records(size) * OVERHEAD;
+}
+
+function records(size: number) {
+  return Math.max(1, Math.ceil(size / CHUNK_SIZE));
+}
+
+const MAX_FILES = 2 ** 24;
+
+function nonce(index: number, counter: number, last: boolean) {
+  if (!Number.isInteger(index) || index < 0 || index >= MAX_FILES) throw new Error("Invalid file index");
+  const iv = new Uint8Array(12);
+  const view = new DataView(iv.buffer);
+  iv[0] = index >>> 16;
+  iv[1] = (index >>> 8) & 0xff;
+  iv[2] = index & 0xff;
+  view.setUint32(3, Math.floor(counter / 2 ** 32));
+  view.setUint32(7, counter >>> 0);
+  iv[11] = last ? 1 : 0;
+  return iv;
+}
+
+async function seal(file: Blob, key: CryptoKey, index: number, counter: number, last: boolean) {
+  const plain = await file.slice(counter * CHUNK_SIZE, (counter + 1) * CHUNK_SIZE).arrayBuffer();
+  const sealed = await crypto.subtle.encrypt({ name: "AES-GCM", iv: nonce(index, counter, last) }, key, plain);
+  const record = new Uint8Array(HEADER_SIZE + sealed.byteLength);
+  new DataView(record.buffer).setUint32(0, (sealed.byteLength + (last ? LAST_FLAG : 0)) >>> 0);
+  record.set(new Uint8Array(sealed), HEADER_SIZE);
+  return record;
+}
+
+/**
+ * Encrypt the bytes of the encrypted stream of file between start and start + length,
+ * index is the index of the file in the transfer.
+ * Encryption is deterministic for a key and index so any range can be produced again when resuming an upload.
+ */
+export async function encryptRange(file: Blob, key: CryptoKey, index: number, start: number, length: number) {
+  const end = Math.min(start + length, encryptedSize(file.size));
+  const count = records(file.size);
+  const first = Math.floor(start / RECORD_SIZE);
+  const last = Math.min(Math.ceil(end / RECORD_SIZE), count);
+  const parts: Uint8Array[] = [];
+  for (let i = first; i < last; i++) {
+    parts.push(await seal(file, key, index, i, i === count - 1));
+  }
+  const base = first * RECORD_SIZE;
+  return concat(parts).subarray(start - base, end - base);
+}
+
+/** Reads exactly n bytes from a stream, failing if the stream ends before. */
+export type ReadFull = (n: number) => Promise<Uint8Array>;
+
+export function readFull(body: ReadableStream<Uint8Array>): ReadFull {
+  const reader = body.getReader();
+  let buffer = new Uint8Array(0);
+  return async (n) => {
+    while (buffer.length < n) {
+      const { done, value } = await reader.read();
+      if (done) throw new Error("Encrypted stream truncated");
+      buffer = concat([buffer, value]);
+    }
+    const out = buffer.slice(0, n);
+    buffer = buffer.subarray(n);
+    return out;
+  };
+}
+
+/**
+ * Decrypt the encrypted stream of the file at index of a transfer,
+ * rejecting streams that are truncated or have been tampered with.
+ */
+export function decryptStream(body: ReadableStream<Uint8Array>, key: CryptoKey, index: number) {
+  return decryptRecords(readFull(body), key, index);
+}
+
+/** Decrypt the records of the file at index of a transfer read with read, it stops after the last record. */
+export async function* decryptRecords(read: ReadFull, key: CryptoKey, index: number) {
+  for (let counter = 0; ; counter++) {
+    const header = new DataView((await read(HEADER_SIZE)).buffer).getUint32(0);
+    const last = header >= LAST_FLAG;
+    const size = header % LAST_FLAG;
+    if (size < TAG_SIZE || size > CHUNK_SIZE + TAG_SIZE) throw new Error("Invalid encrypted record");
+    const sealed = await read(size);
+    const plain = await crypto.subtle.decrypt({ name: "AES-GCM", iv: nonce(index, counter, last) }, key, sealed);
+    yield new Uint8Array(plain);
+    if (last) return;
+  }
+}
+
+export function concat(parts: Uint8Array[]) {
+  const out = new Uint8Array(parts.reduce((n, part) => n + part.length, 0));
+  let offset = 0;
+  for (const part of parts) {
+    out.set(part, offset);
+    offset += part.length;
+  }
+  return out;
+}
+
+window.generateKey = generateKey;
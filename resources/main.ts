@@ -3,4 +3,7 @@ import "vite/modulepreload-polyfill";
 import "./htmx";
 import "htmx.org/dist/ext/sse";
 import "htmx.org/dist/ext/response-targets";
+import "./upload";
+import "./download";
+import "./countdown";
 import "./aplinejs";
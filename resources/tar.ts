@@ -0,0 +1,124 @@
+// Minimal tar reader and writer, used to decrypt the entries of archives of end-to-end encrypted files.
+import { concat, type ReadFull } from "./e2e";
+
+const BLOCK_SIZE = 512;
+// sizes are stored as 11 octal digits in the header, larger sizes are stored in a PAX record
+const MAX_OCTAL_SIZE = 8 ** 11 - 1;
+
+export type TarEntry = {
+  path: string;
+  size: number;
+  /** Read bytes of the entry, it must be read to the end before the next entry. */
+  read: ReadFull;
+};
+
+/** Read the regular files of a tar stream in order, entry is called for each of them. */
+export async function readTar(read: ReadFull, entry: (entry: TarEntry) => Promise<void>) {
+  let pax: Record<string, string> = {};
+  for (;;) {
+    const header = await read(BLOCK_SIZE);
+    // the archive ends with empty blocks
+    if (header.every((b) => b === 0)) return;
+    const type = String.fromCharCode(header[156]);
+    let size = parseOctal(header.subarray(124, 136));
+
+    if (type === "x") {
+      pax = parsePax(await read(size));
+      await read(padding(size));
+      continue;
+    }
+    if (pax.size) size = Number(pax.size);
+    if (type !== "0" && type !== "\0") {
+      await read(size + padding(size));
+      pax = {};
+      continue;
+    }
+    const name = text(header.subarray(0, 100));
+    const prefix = text(header.subarray(345, 500));
+    const path = pax.path || (prefix ? `${prefix}/${name}` : name);
+    pax = {};
+
+    let remaining = size;
+    await entry({
+      path,
+      size,
+      read: (n) => {
+        if (n > remaining) throw new Error("Invalid archive entry");
+        remaining -= n;
+        return read(n);
+      },
+    });
+    if (remaining > 0) throw new Error("Invalid archive entry");
+    await read(padding(size));
+  }
+}
+
+/** Blocks of a tar archive with files of the given paths and contents. */
+export function writeTar(files: { path: string; content: Uint8Array[] }[]) {
+  const parts: Uint8Array[] = [];
+  for (const { path, content } of files) {
+    const size = content.reduce((n, part) => n + part.length, 0);
+    // the path is stored in a PAX record so it can be of any length
+    const records = [paxRecord("path", path)];
+    if (size > MAX_OCTAL_SIZE) records.push(paxRecord("size", String(size)));
+    const pax = concat(records);
+    parts.push(header("PaxHeader", pax.length, "x"), pax, new Uint8Array(padding(pax.length)));
+    parts.push(header(path, Math.min(size, MAX_OCTAL_SIZE), "0"), ...content, new Uint8Array(padding(size)));
+  }
+  parts.push(new Uint8Array(BLOCK_SIZE * 2));
+  return parts;
+}
+
+function header(name: string, size: number, type: string) {
+  const block = new Uint8Array(BLOCK_SIZE);
+  const set = (offset: number, value: string) => block.set(new TextEncoder().encode(value), offset);
+  block.set(new TextEncoder().encode(name).subarray(0, 100), 0);
+  set(100, "0000644\0");
+  set(108, "0000000\0");
+  set(116, "0000000\0");
+  set(124, size.toString(8).padStart(11, "0") + "\0");
+  set(136, Math.floor(Date.now() / 1000).toString(8).padStart(11, "0") + "\0");
+  set(156, type);
+  set(257, "ustar\0" + "00");
+  // the checksum is computed with its own field filled with spaces
+  set(148, " ".repeat(8));
+  const sum = block.reduce((n, b) => n + b, 0);
+  set(148, sum.toString(8).padStart(6, "0") + "\0 ");
+  return block;
+}
+
+function paxRecord(key: string, value: string) {
+  const body = new TextEncoder().encode(` ${key}=${value}\n`);
+  // the length of a record includes its own digits
+  let length = body.length + 1;
+  while (String(length).length + body.length > length) length++;
+  return concat([new TextEncoder().encode(String(length)), body]);
+}
+
+function parsePax(data: Uint8Array) {
+  const records: Record<string, string> = {};
+  let offset = 0;
+  while (offset < data.length) {
+    const space = data.indexOf(0x20, offset);
+    const length = Number(text(data.subarray(offset, space)));
+    if (space < 0 || !length) throw new Error("Invalid archive header");
+    const record = new TextDecoder().decode(data.subarray(space + 1, offset + length - 1));
+    const eq = record.indexOf("=");
+    records[record.slice(0, eq)] = record.slice(eq + 1);
+    offset += length;
+  }
+  return records;
+}
+
+function parseOctal(field: Uint8Array) {
+  return parseInt(text(field).trim() || "0", 8);
+}
+
+function text(field: Uint8Array) {
+  const end = field.indexOf(0);
+  return new TextDecoder().decode(end < 0 ? field : field.subarray(0, end));
+}
+
+function padding(size: number) {
+  return (BLOCK_SIZE - (size % BLOCK_SIZE)) % BLOCK_SIZE;
+}
@@ -0,0 +1,116 @@
+import { encryptRange, encryptedSize, importKey } from "./e2e";
+
+const TUS_VERSION = "1.0.0";
+const CHUNK_SIZE = 8 * 1024 * 1024;
+const MAX_RETRY_DELAY = 30_000;
+
+export type UploadFile = {
+  filename: string;
+  path: string;
+  size: number;
+  contentType: string;
+};
+
+export class UploadError extends Error {
+  constructor(
+    public status: number,
+    message?: string,
+    /** Milliseconds to wait before retrying, set when the server asks the client to retry. */
+    public retryAfter?: number,
+  ) {
+    super(
+      message || (status === 401 ? "Unauthorized to send" : status === 404 ? "Connection not found" : "Upload failed"),
+    );
+  }
+
+  /** Create an error from a failed response, using the message and description of the server when available. */
+  static async from(res: Response) {
+    const body = await res.json().catch(() => undefined);
+    const error: { message?: string; description?: string } | undefined = body?.error;
+    const retryAfter = res.status === 503 ? Number(res.headers.get("Retry-After") || 1) * 1000 : undefined;
+    return new UploadError(
+      res.status,
+      error && [error.message, error.description].filter(Boolean).join(": "),
+      retryAfter,
+    );
+  }
+}
+
+/**
+ * Upload files in chunks to a connection using the chunked upload protocol.
+ * Network failures are retried with backoff and the upload resumes from the offset stored on the server.
+ * Files are end-to-end encrypted when a key is given, offsets and sizes are then those of the encrypted stream.
+ */
+export async function upload(id: string, files: FileList | File[], paths: string[] = [], key?: string) {
+  const list = Array.from(files);
+  const cryptoKey = key ? await importKey(key) : undefined;
+  const manifest: UploadFile[] = list.map((file, i) => ({
+    filename: file.name,
+    path: paths[i] || file.webkitRelativePath || file.name,
+    size: cryptoKey ? encryptedSize(file.size) : file.size,
+    contentType: file.type || "application/octet-stream",
+  }));
+  const base = `/transfer/${id}/uploads`;
+
+  await retry(async () => {
+    const res = await fetch(base, {
+      method: "POST",
+      headers: { "Tus-Resumable": TUS_VERSION, "Content-Type": "application/json", Accept: "application/json" },
+      body: JSON.stringify({ files: manifest, encrypted: !!cryptoKey }),
+    });
+    if (!res.ok) throw await UploadError.from(res);
+  });
+
+  for (let i = 0; i < list.length; i++) {
+    const file = list[i];
+    const size = manifest[i].size;
+    let offset = 0;
+    // empty files still need a single chunk to complete
+    do {
+      offset = await retry(async () => {
+        const res = await fetch(`${base}/${i}`, {
+          method: "PATCH",
+          headers: {
+            "Tus-Resumable": TUS_VERSION,
+            "Content-Type": "application/offset+octet-stream",
+            "Upload-Offset": String(offset),
+            Accept: "application/json",
+          },
+          body: cryptoKey
+            ? await encryptRange(file, cryptoKey, i, offset, CHUNK_SIZE)
+            : file.slice(offset, offset + CHUNK_SIZE),
+        });
+        if (res.ok || res.status === 409) return Number(res.headers.get("Upload-Offset"));
+        throw await UploadError.from(res);
+      }, () => currentOffset(`${base}/${i}`).then((current) => (offset = current)));
+    } while (offset < size);
+  }
+}
+
+async function currentOffset(url: string) {
+  const res = await fetch(url, { method: "HEAD", headers: { "Tus-Resumable": TUS_VERSION } });
+  if (!res.ok) throw new UploadError(res.status);
+  return Number(res.headers.get("Upload-Offset"));
+}
+
+/**
+ * Retry fn on network failures with exponential backoff, calling resume before each retry.
+ * Errors returned by the server are not retried, unless it asks to retry like while a direct transfer waits for a receiver.
+ */
+async function retry<T>(fn: () => Promise<T>, resume?: () => Promise<unknown>): Promise<T> {
+  for (let attempt = 0; ; attempt++) {
+    try {
+      if (attempt > 0 && resume) await resume();
+      return await fn();
+    } catch (err) {
+      let delay = Math.min(1000 * 2 ** attempt, MAX_RETRY_DELAY);
+      if (err instanceof UploadError) {
+        if (err.retryAfter === undefined) throw err;
+        delay = err.retryAfter;
+      }
+      await new Promise((resolve) => setTimeout(resolve, delay));
+    }
+  }
+}
+
+window.upload = upload;
@@ -1,9 +1,13 @@
 import { Alpine } from "alpinejs";
 import htmx from "htmx.org";
+import { generateKey } from "./resources/e2e";
+import { upload } from "./resources/upload";
 
 declare global {
   interface Window {
     Alpine: Alpine;
     htmx: typeof htmx;
+    upload: typeof upload;
+    generateKey: typeof generateKey;
   }
 }
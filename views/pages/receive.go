@@ -3,7 +3,9 @@ package pages
 import "github.com/eriicafes/tmpl"
 
 type ReceiveForm struct {
-	ID string
+	ID      string
+	Code    string
+	CodeLen int
 }
 
 func (t ReceiveForm) AssociatedTemplate() (string, string, any) {
@@ -15,6 +17,9 @@ func (t ReceiveForm) AssociatedTemplate() (string, string, any) {
 
 type ReceivePage struct {
 	ID string
+	// Code prefills the request form of protected connections.
+	Code    string
+	CodeLen int
 }
 
 func (t ReceivePage) Template() (string, any) {
@@ -3,7 +3,8 @@ package pages
 import "github.com/eriicafes/tmpl"
 
 type SendForm struct {
-	ID string
+	ID        string
+	Broadcast bool
 }
 
 func (t SendForm) AssociatedTemplate() (string, string, any) {
@@ -21,7 +22,15 @@ func (t SendCompleted) AssociatedTemplate() (string, string, any) {
 	return "pages/send", "send-completed", t
 }
 
-type SendPage struct{}
+// Expiry is an option for how long a connection is kept, the empty Value is the longest expiry.
+type Expiry struct {
+	Value string
+	Label string
+}
+
+type SendPage struct {
+	Expiries []Expiry
+}
 
 func (t SendPage) Template() (string, any) {
 	return tmpl.Tmpl("pages/send", RootLayout{"Send"}, t).Template()
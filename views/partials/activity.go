@@ -10,12 +10,40 @@ func (t ActivityConnector) AssociatedTemplate() (string, string, any) {
 
 type ActivityProgress struct {
 	Progress string
+	// Rate is the transfer rate over the last second, it is empty once the transfer completes.
+	Rate string
 }
 
 func (t ActivityProgress) AssociatedTemplate() (string, string, any) {
 	return "partials/activity", "activity-progress", t
 }
 
+type ActivityReceivers struct {
+	Count int
+}
+
+func (t ActivityReceivers) AssociatedTemplate() (string, string, any) {
+	return "partials/activity", "activity-receivers", t
+}
+
+type ActivityChecksum struct {
+	Path string
+	Sum  string
+}
+
+func (t ActivityChecksum) AssociatedTemplate() (string, string, any) {
+	return "partials/activity", "activity-checksum", t
+}
+
+type ActivityExpiry struct {
+	// ExpiresAt is when the connection expires formatted as RFC 3339.
+	ExpiresAt string
+}
+
+func (t ActivityExpiry) AssociatedTemplate() (string, string, any) {
+	return "partials/activity", "activity-expiry", t
+}
+
 type ActivityItem struct {
 	Event string
 	Data  string
@@ -0,0 +1,18 @@
+package partials
+
+type TransferFile struct {
+	Name string
+	// Size is the formatted size of the file.
+	Size string
+}
+
+type TransferFiles struct {
+	ID        string
+	Files     []TransferFile
+	Download  bool
+	Encrypted bool
+}
+
+func (t TransferFiles) AssociatedTemplate() (string, string, any) {
+	return "partials/files", "transfer-files", t
+}